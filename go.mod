@@ -1,5 +1,8 @@
 module github.com/kofrasa/rpc/xml
 
-go 1.14
+go 1.20
 
-require github.com/gorilla/rpc v1.2.0
+require (
+	github.com/gorilla/rpc v1.2.0
+	github.com/klauspost/compress v1.17.9
+)
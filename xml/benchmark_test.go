@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net/http"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -67,3 +70,94 @@ func Benchmark_WriterQuoted(b *testing.B) {
 		w.writeValue(largeRPCQuoted)
 	}
 }
+
+func Benchmark_ReaderStream(b *testing.B) {
+	buf := strings.NewReader(largeXML)
+	d := NewDecoder(buf)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Seek(0, io.SeekStart)
+		d.codec.rd.reset(buf)
+		d.DecodeArrayStream(func(int, *Value) error { return nil })
+	}
+}
+
+func Benchmark_WithBufferParallel(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			withBuffer(func(buf *bytes.Buffer) error {
+				buf.WriteString(largeXML[:512])
+				return nil
+			})
+		}
+	})
+}
+
+// Benchmark_WithBufferMutexParallel measures the previous scheme of a pool per method behind a mutex for comparison
+func Benchmark_WithBufferMutexParallel(b *testing.B) {
+	var mtx sync.Mutex
+	pools := make(map[string]*sync.Pool)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mtx.Lock()
+			pool, ok := pools["Arith.Add"]
+			if !ok {
+				pool = &sync.Pool{
+					New: func() interface{} { return bytes.NewBuffer([]byte{}) },
+				}
+				pools["Arith.Add"] = pool
+			}
+			mtx.Unlock()
+
+			buf := pool.Get().(*bytes.Buffer)
+			buf.WriteString(largeXML[:512])
+			buf.Reset()
+			pool.Put(buf)
+		}
+	})
+}
+
+// Benchmark_ClientManyMethods reports the heap growth of a client calling many distinct methods
+func Benchmark_ClientManyMethods(b *testing.B) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<methodResponse><params><param><value><int>1</int></value></param></params></methodResponse>"))
+	})
+	c := NewClient("http://rpc", WithRoundTripper(NewInMemoryTransport(handler)))
+
+	heapAlloc := func() int64 {
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return int64(m.HeapAlloc)
+	}
+
+	var n int
+	before := heapAlloc()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Call(fmt.Sprintf("Service.Method%d", i), &n)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(heapAlloc()-before), "heap-growth-bytes")
+	runtime.KeepAlive(c)
+}
+
+func Benchmark_Compression(b *testing.B) {
+	payload := []byte(createXML(1e4, "Allan Watt"))
+	for _, enc := range []string{"gzip", "deflate", "zstd"} {
+		b.Run(enc, func(b *testing.B) {
+			var buf bytes.Buffer
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				zw := newCompressWriter(&buf, enc)
+				zw.Write(payload)
+				zw.Close()
+			}
+			b.ReportMetric(float64(buf.Len()), "compressed-bytes")
+		})
+	}
+}
@@ -2,28 +2,68 @@ package xml
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// the most bytes of the body of a failed HTTP response kept in the error
+	maxErrorBodySize = 512
+	// the largest capacity of a request buffer returned to the pool
+	maxPooledBufferSize = 1 << 20
+	// the keep-alive period of connections dialed by the client, as used by http.DefaultTransport
+	defaultKeepAlive = 30 * time.Second
+)
+
+var (
+	// a pool of request buffers shared by clients. use via the withBuffer function
+	bufferPool = &sync.Pool{
+		New: func() interface{} { return bytes.NewBuffer([]byte{}) },
+	}
+	defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
 )
 
 // A Client is used to make XML-RPC calls.
 type Client struct {
-	url        string
-	username   string
-	password   string
-	client     *http.Client
-	header     http.Header
-	bufPoolMap map[string]*sync.Pool
-	bufMtx     sync.Mutex
+	url             string
+	username        string
+	password        string
+	client          *http.Client
+	header          http.Header
+	timeout         time.Duration
+	encoding        string
+	retry           retryPolicy
+	logRequest      func(method string, body []byte)
+	logResponse     func(body []byte)
+	maxResponseSize int64
+	codecs          *sync.Pool
+	httpMethod      string
+	ownsTransport   bool // the transport was created for the client by an option
 }
 
 // NewClient returns a new XML-RPC client.
 func NewClient(url string, options ...func(*Client)) *Client {
 	c := &Client{
 		url:        url,
-		bufPoolMap: make(map[string]*sync.Pool),
+		retry:      retryPolicy{attempts: 1, statuses: defaultRetryStatuses},
 		client:     http.DefaultClient,
 		header:     make(http.Header),
+		codecs:     codecPool,
+		httpMethod: http.MethodPost,
 	}
 
 	for _, opt := range options {
@@ -36,17 +76,129 @@ func NewClient(url string, options ...func(*Client)) *Client {
 }
 
 // WithBasicAuth configure client with basic HTTP authentication.
+// Replaces any authorization configured with WithAuthHeader or WithBearerToken.
 func WithBasicAuth(username, password string) func(*Client) {
 	return func(c *Client) {
 		c.username = username
 		c.password = password
+		c.header.Del("Authorization")
 	}
 }
 
+// WithAuthHeader configure the value of the Authorization header sent with each request.
+// Replaces any authorization configured with WithBasicAuth.
+func WithAuthHeader(value string) func(*Client) {
+	return func(c *Client) {
+		c.header.Set("Authorization", value)
+		c.username = ""
+		c.password = ""
+	}
+}
+
+// WithBearerToken configure client with bearer token authentication.
+// Replaces any authorization configured with WithBasicAuth.
+func WithBearerToken(token string) func(*Client) {
+	return WithAuthHeader("Bearer " + token)
+}
+
 // WithHTTPClient confgure a custom HTTP client to use for connecting to server.
 func WithHTTPClient(httpClient *http.Client) func(*Client) {
 	return func(c *Client) {
 		c.client = httpClient
+		c.ownsTransport = false
+	}
+}
+
+// WithRoundTripper configure the transport used to send requests, such as one returned by NewInMemoryTransport.
+func WithRoundTripper(rt http.RoundTripper) func(*Client) {
+	return func(c *Client) {
+		client := *c.client
+		client.Transport = rt
+		c.client = &client
+		c.ownsTransport = false
+	}
+}
+
+// WithCookieJar configure a jar to store cookies set by the server and send them with later calls,
+// such as a session cookie set by a login method. A nil jar uses a new in-memory jar.
+func WithCookieJar(jar http.CookieJar) func(*Client) {
+	return func(c *Client) {
+		if jar == nil {
+			// cookiejar.New only fails for invalid options
+			jar, _ = cookiejar.New(nil)
+		}
+		client := *c.client
+		client.Jar = jar
+		c.client = &client
+	}
+}
+
+// WithClientCertificate configure a certificate to present to servers requiring mutual TLS.
+// It has no effect when the client uses a transport other than *http.Transport.
+func WithClientCertificate(cert tls.Certificate) func(*Client) {
+	return func(c *Client) {
+		c.configureTLS(func(config *tls.Config) {
+			config.Certificates = append(config.Certificates, cert)
+		})
+	}
+}
+
+// WithRootCAs configure the certificate authorities used to verify servers.
+// It has no effect when the client uses a transport other than *http.Transport.
+func WithRootCAs(pool *x509.CertPool) func(*Client) {
+	return func(c *Client) {
+		c.configureTLS(func(config *tls.Config) {
+			config.RootCAs = pool
+		})
+	}
+}
+
+// WithInsecureSkipVerify configure the client to accept any certificate presented by the server.
+// This disables protection against man-in-the-middle attacks and should only be used for testing,
+// such as with self-signed certificates. Prefer WithRootCAs to trust a specific certificate.
+// It has no effect when the client uses a transport other than *http.Transport.
+func WithInsecureSkipVerify() func(*Client) {
+	return func(c *Client) {
+		c.configureTLS(func(config *tls.Config) {
+			config.InsecureSkipVerify = true
+		})
+	}
+}
+
+// WithTLSMinVersion configure the minimum TLS version accepted from servers, such as tls.VersionTLS12.
+// It has no effect when the client uses a transport other than *http.Transport.
+func WithTLSMinVersion(version uint16) func(*Client) {
+	return func(c *Client) {
+		c.configureTLS(func(config *tls.Config) {
+			config.MinVersion = version
+		})
+	}
+}
+
+// WithProxy configure the client to send requests through the HTTP proxy at the URL.
+// Calls fail with the parse error when the URL is invalid.
+// It has no effect when the client uses a transport other than *http.Transport.
+func WithProxy(proxyURL string) func(*Client) {
+	return func(c *Client) {
+		u, err := url.Parse(proxyURL)
+		c.configureTransport(func(t *http.Transport) {
+			if err != nil {
+				t.Proxy = func(*http.Request) (*url.URL, error) { return nil, err }
+				return
+			}
+			t.Proxy = http.ProxyURL(u)
+		})
+	}
+}
+
+// WithProxyFromEnvironment configure the client to use the proxy from the HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY environment variables as described by http.ProxyFromEnvironment.
+// It has no effect when the client uses a transport other than *http.Transport.
+func WithProxyFromEnvironment() func(*Client) {
+	return func(c *Client) {
+		c.configureTransport(func(t *http.Transport) {
+			t.Proxy = http.ProxyFromEnvironment
+		})
 	}
 }
 
@@ -61,22 +213,308 @@ func WithHTTPHeader(header http.Header) func(*Client) {
 	}
 }
 
+// WithCodec configure the codec settings used to write requests and read responses.
+// The settings are copied so later changes to the codec do not affect the client.
+func WithCodec(codec *Codec) func(*Client) {
+	return func(c *Client) {
+		c.codecs = newCodecPool(codec)
+	}
+}
+
+// WithRequestCompression configure the client to compress requests with the encoding, "gzip", "deflate" or "zstd",
+// and ask for responses compressed with the same encoding. Other encodings are ignored.
+func WithRequestCompression(encoding string) func(*Client) {
+	return func(c *Client) {
+		switch encoding {
+		case "gzip", "deflate", "zstd":
+			c.encoding = encoding
+			c.header.Set("Content-Encoding", encoding)
+			c.header.Set("Accept-Encoding", encoding)
+		}
+	}
+}
+
+// WithRetry configure the client to retry a call up to maxAttempts times on connection resets, network timeouts
+// and retryable HTTP statuses, waiting for the backoff duration before each new attempt.
+// Faults, cancellation, certificate errors and invalid URLs are never retried. The client timeout covers all attempts.
+func WithRetry(maxAttempts int, backoff func(attempt int) time.Duration) func(*Client) {
+	return func(c *Client) {
+		c.retry.attempts = maxAttempts
+		c.retry.backoff = backoff
+	}
+}
+
+// WithRetryStatus configure the HTTP statuses that are retried.
+// Defaults to 502 Bad Gateway, 503 Service Unavailable and 504 Gateway Timeout.
+func WithRetryStatus(statuses ...int) func(*Client) {
+	return func(c *Client) {
+		c.retry.statuses = statuses
+	}
+}
+
+// WithHTTPMethod configure the HTTP method of requests for gateways which do not accept POST.
+// The request is sent in the body whatever the method. Defaults to POST as required by the spec.
+func WithHTTPMethod(method string) func(*Client) {
+	return func(c *Client) {
+		c.httpMethod = method
+	}
+}
+
+// WithTimeout configure a time limit for each call. The timeout covers connecting,
+// sending the request and reading the response. A zero timeout means no timeout.
+func WithTimeout(d time.Duration) func(*Client) {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithDialTimeout configure a time limit for establishing connections to the server
+// independent of the time limit for each call set with WithTimeout.
+// The time limit applies to the dial function of the transport, or a default dialer when it has none.
+// It has no effect when the client uses a transport other than *http.Transport.
+func WithDialTimeout(d time.Duration) func(*Client) {
+	return func(c *Client) {
+		c.configureTransport(func(t *http.Transport) {
+			dial := t.DialContext
+			if dial == nil {
+				dial = (&net.Dialer{KeepAlive: defaultKeepAlive}).DialContext
+			}
+			t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, d)
+				defer cancel()
+				return dial(ctx, network, addr)
+			}
+		})
+	}
+}
+
+// WithRequestLogger configure a hook called with the method and encoded body of each request before it is sent.
+// The body is compressed when request compression is enabled. The hook receives a copy which it may retain.
+func WithRequestLogger(logger func(method string, body []byte)) func(*Client) {
+	return func(c *Client) {
+		c.logRequest = logger
+	}
+}
+
+// WithResponseLogger configure a hook called with the decompressed body of each response before it is decoded.
+// The response is read fully into memory when a logger is configured.
+func WithResponseLogger(logger func(body []byte)) func(*Client) {
+	return func(c *Client) {
+		c.logResponse = logger
+	}
+}
+
+// WithMaxResponseSize configure the most bytes read from a response after decompression.
+// Larger responses fail with a MalformedInput fault. A zero size means no limit.
+func WithMaxResponseSize(n int64) func(*Client) {
+	return func(c *Client) {
+		c.maxResponseSize = n
+	}
+}
+
+// TimeoutError is returned when a call does not complete within the client timeout.
+type TimeoutError struct {
+	Method   string
+	Duration time.Duration
+}
+
+// Error returns a formatted error string
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("call to '%s' timed out after %s", e.Method, e.Duration)
+}
+
+// Timeout reports whether the error is a timeout. Always true.
+func (e TimeoutError) Timeout() bool {
+	return true
+}
+
+// HTTPError is returned when the server responds with a status other than 200 OK.
+// Body holds the start of the response body.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+// Error returns a formatted error string
+func (e HTTPError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
 // Call sends an XML-RPC request to the server.
-// If a non-nil error is returned, it may be an rpc.Fault or some other type of error
+// If a non-nil error is returned, it may be an rpc.Fault, a TimeoutError, an HTTPError or some other type of error.
+// A *MethodResponse reply receives the whole response and a fault is not returned as an error.
 func (c *Client) Call(method string, reply interface{}, args ...interface{}) error {
-	return withCodec(func(codec *Codec) error {
-		return c.withBuffer(method, func(buf *bytes.Buffer) error {
-			if err := codec.writeRequest(buf, method, args...); err != nil {
+	return c.do(context.Background(), method, nil, encodeCall(method, args), func(codec *Codec, r io.Reader) error {
+		return codec.readResponse(r, reply)
+	})
+}
+
+// CallMulti sends an XML-RPC request to the server for methods returning multiple params.
+// Each param of the response is written to the reply at the same position and
+// an error is returned when the number of params and replies differ.
+func (c *Client) CallMulti(method string, replies []interface{}, args ...interface{}) error {
+	return c.do(context.Background(), method, nil, encodeCall(method, args), func(codec *Codec, r io.Reader) error {
+		return codec.readResponseParams(r, replies)
+	})
+}
+
+// CallOptions holds settings which apply to a single call.
+type CallOptions struct {
+	// Header holds headers added to the request on top of the client headers
+	Header http.Header
+	// ExpandStruct sends the fields of a single struct argument as positional params
+	ExpandStruct bool
+}
+
+// WithCallHeader set a header for a single call such as a trace ID or an idempotency key.
+func WithCallHeader(key, value string) func(*CallOptions) {
+	return func(o *CallOptions) {
+		if o.Header == nil {
+			o.Header = make(http.Header)
+		}
+		o.Header.Set(key, value)
+	}
+}
+
+// WithExpandedStruct send the fields of a single struct argument as positional params in declaration order
+// for servers which define methods with one param per field.
+func WithExpandedStruct() func(*CallOptions) {
+	return func(o *CallOptions) {
+		o.ExpandStruct = true
+	}
+}
+
+// CallWithOptions sends an XML-RPC request to the server like Call applying the options to this call only.
+// The client configuration is not modified.
+func (c *Client) CallWithOptions(method string, reply interface{}, args []interface{}, options ...func(*CallOptions)) error {
+	var opts CallOptions
+	for _, opt := range options {
+		opt(&opts)
+	}
+	write := encodeCall(method, args)
+	if opts.ExpandStruct {
+		if len(args) != 1 {
+			return InvalidParams.New("expected a single struct argument to expand got %d arguments", len(args))
+		}
+		write = func(codec *Codec, w io.Writer) error {
+			params, err := expandStruct(args[0], &codec.cfg)
+			if err != nil {
+				return err
+			}
+			return codec.writeRequest(w, method, params...)
+		}
+	}
+	return c.do(context.Background(), method, opts.Header, write, func(codec *Codec, r io.Reader) error {
+		return codec.readResponse(r, reply)
+	})
+}
+
+// CallRaw sends the prebuilt XML-RPC request body to the server and decodes the response into reply.
+// The body is sent as is, without encoding, and is compressed when request compression is configured.
+func (c *Client) CallRaw(ctx context.Context, body []byte, reply interface{}) error {
+	write := func(_ *Codec, w io.Writer) error {
+		_, err := w.Write(body)
+		return err
+	}
+	return c.do(ctx, rawMethodName(body), nil, write, func(codec *Codec, r io.Reader) error {
+		return codec.readResponse(r, reply)
+	})
+}
+
+// Do sends an XML-RPC request to the server and returns the decoded response without interpreting it.
+// A fault returned by the server is not an error and is available from the Fault method of the response.
+func (c *Client) Do(ctx context.Context, method string, args ...interface{}) (*MethodResponse, error) {
+	res := &MethodResponse{}
+	err := c.do(ctx, method, nil, encodeCall(method, args), func(codec *Codec, r io.Reader) error {
+		return codec.readRPC(r, res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// rawMethodName returns the method name of an encoded request for errors and logging.
+// The name is empty when the body has no valid methodName element
+func rawMethodName(body []byte) string {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.CharsetReader = charsetReader
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		if se, ok := t.(xml.StartElement); ok && se.Name.Local == "methodName" {
+			var name string
+			if dec.DecodeElement(&name, &se) != nil {
+				return ""
+			}
+			return strings.TrimSpace(name)
+		}
+	}
+}
+
+// encodeCall returns a callback which encodes a request for the method and args
+func encodeCall(method string, args []interface{}) func(*Codec, io.Writer) error {
+	return func(codec *Codec, w io.Writer) error {
+		return codec.writeRequest(w, method, args...)
+	}
+}
+
+// do sends the request written by the write callback with the additional headers
+// and decodes the response body with the read callback.
+func (c *Client) do(parent context.Context, method string, header http.Header, write func(*Codec, io.Writer) error, read func(*Codec, io.Reader) error) error {
+	ctx := parent
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, c.timeout)
+		defer cancel()
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		// the request is encoded again for each attempt
+		err = c.send(ctx, method, header, write, read)
+		if attempt >= c.retry.attempts || ctx.Err() != nil || !c.retry.retryable(err) {
+			break
+		}
+		if c.retry.wait(ctx, attempt) != nil {
+			break
+		}
+	}
+
+	if _, ok := err.(Fault); err == nil || ok || ctx.Err() == nil {
+		return err
+	}
+	// the deadline or cancellation of the caller is reported as is
+	if parent.Err() != nil {
+		return fmt.Errorf("call to '%s' stopped: %w", method, parent.Err())
+	}
+	return TimeoutError{Method: method, Duration: c.timeout}
+}
+
+func (c *Client) send(ctx context.Context, method string, header http.Header, write func(*Codec, io.Writer) error, read func(*Codec, io.Reader) error) error {
+	return withPooledCodec(c.codecs, func(codec *Codec) error {
+		return withBuffer(func(buf *bytes.Buffer) error {
+			if err := c.writeRequest(codec, buf, write); err != nil {
 				return err
 			}
 
-			req, err := http.NewRequest("POST", c.url, buf)
+			// the buffer is reused after the call so the logger gets a copy
+			if c.logRequest != nil {
+				c.logRequest(method, append([]byte(nil), buf.Bytes()...))
+			}
+
+			req, err := http.NewRequestWithContext(ctx, c.httpMethod, c.url, buf)
 			if err != nil {
 				return err
 			}
 
-			// set custom request headers
-			req.Header = c.header
+			// set custom request headers on a copy so concurrent requests do not share the client headers
+			req.Header = c.header.Clone()
+			for k, v := range header {
+				req.Header[k] = v
+			}
 
 			if c.username != "" && c.password != "" {
 				req.SetBasicAuth(c.username, c.password)
@@ -87,28 +525,181 @@ func (c *Client) Call(method string, reply interface{}, args ...interface{}) err
 				return err
 			}
 
-			dec := newDecompressor(resp)
-			err = codec.readResponse(dec, reply)
-			dec.Close()
-			return err
+			// XML-RPC responses are always 200 OK
+			if resp.StatusCode != http.StatusOK {
+				body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+				resp.Body.Close()
+				return HTTPError{StatusCode: resp.StatusCode, Body: string(body)}
+			}
+
+			dec, err := newDecompressor(resp.Body, resp.Header)
+			if err != nil {
+				resp.Body.Close()
+				return err
+			}
+			defer dec.Close()
+
+			var body io.Reader = dec
+			if c.maxResponseSize > 0 {
+				body = &sizeLimitReader{r: dec, remaining: c.maxResponseSize, limit: c.maxResponseSize}
+			}
+
+			// the logger gets the decompressed body within the size limit
+			if c.logResponse != nil {
+				b, err := ioutil.ReadAll(body)
+				if err != nil {
+					return err
+				}
+				c.logResponse(b)
+				return read(codec, bytes.NewReader(b))
+			}
+			return read(codec, body)
 		})
 	})
 }
 
-func (c *Client) withBuffer(method string, fn func(*bytes.Buffer) error) error {
-	c.bufMtx.Lock()
-	pool, ok := c.bufPoolMap[method]
+// sizeLimitReader reads from r failing with a MalformedInput fault once more than limit bytes are read
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// the input may end exactly at the limit
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, MalformedInput.New("response exceeds %d bytes", l.limit)
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// retryPolicy decides whether a failed call is sent again
+type retryPolicy struct {
+	attempts int
+	backoff  func(attempt int) time.Duration
+	statuses []int
+}
+
+// retryable reports whether the error is a temporary transport error or a retryable HTTP status
+func (p *retryPolicy) retryable(err error) bool {
+	switch e := err.(type) {
+	case *url.Error:
+		return temporary(e.Err)
+	case HTTPError:
+		for _, status := range p.statuses {
+			if e.StatusCode == status {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// temporary reports whether a transport error is a connection reset, a network timeout or
+// a temporary network error. Cancellation, certificate errors and invalid requests are not temporary
+func temporary(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &verifyErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && (netErr.Timeout() || netErr.Temporary())
+}
+
+// wait blocks for the backoff of the attempt or until the context is done
+func (p *retryPolicy) wait(ctx context.Context, attempt int) error {
+	if p.backoff == nil {
+		return nil
+	}
+	timer := time.NewTimer(p.backoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// configureTransport updates a copy of the client transport.
+// Transports other than *http.Transport are left unchanged
+func (c *Client) configureTransport(fn func(*http.Transport)) {
+	rt := c.client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	t, ok := rt.(*http.Transport)
 	if !ok {
-		pool = &sync.Pool{
-			New: func() interface{} { return bytes.NewBuffer([]byte{}) },
+		return
+	}
+	t = t.Clone()
+	fn(t)
+	client := *c.client
+	client.Transport = t
+	c.client = &client
+	c.ownsTransport = true
+}
+
+// configureTLS updates the TLS configuration of a copy of the client transport
+func (c *Client) configureTLS(fn func(*tls.Config)) {
+	c.configureTransport(func(t *http.Transport) {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
 		}
-		c.bufPoolMap[method] = pool
+		fn(t.TLSClientConfig)
+	})
+}
+
+// writeRequest writes the request to the buffer, compressed if configured
+func (c *Client) writeRequest(codec *Codec, buf *bytes.Buffer, write func(*Codec, io.Writer) error) error {
+	zw := newCompressWriter(buf, c.encoding)
+	if zw == nil {
+		return write(codec, buf)
+	}
+	err := write(codec, zw)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
 	}
-	c.bufMtx.Unlock()
+	return err
+}
+
+// Close closes idle connections of the transport created for the client by options such as WithDialTimeout.
+// Shared transports, such as http.DefaultTransport or one configured with WithHTTPClient or WithRoundTripper,
+// are left for their owner to close. The client remains usable after Close.
+func (c *Client) Close() {
+	if c.ownsTransport {
+		c.client.CloseIdleConnections()
+	}
+}
 
-	buf := pool.Get().(*bytes.Buffer)
+// withBuffer acquires a buffer from the shared pool for the callback and release when done.
+// Large buffers are not returned to the pool to bound the memory held by the pool
+func withBuffer(fn func(*bytes.Buffer) error) error {
+	buf := bufferPool.Get().(*bytes.Buffer)
 	err := fn(buf)
-	buf.Reset()
-	pool.Put(buf)
+	if buf.Cap() <= maxPooledBufferSize {
+		buf.Reset()
+		bufferPool.Put(buf)
+	}
 	return err
 }
@@ -2,11 +2,18 @@ package xml
 
 import (
 	"encoding/xml"
+	"errors"
 	"io"
 	"io/ioutil"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	// default limit for nested values when decoding
+	defaultMaxDepth = 64
 )
 
 var (
@@ -19,35 +26,225 @@ var (
 
 // Codec reads and writes XML-RPC messages.
 type Codec struct {
-	rd *xmlReader
-	wr *xmlWriter
+	cfg codecConfig
+	rd  *xmlReader
+	wr  *xmlWriter
+
+	// member names of the last decoded value when tracking present fields
+	present map[string]bool
+}
+
+// codecConfig holds the settings shared by the reader and writer of a codec
+type codecConfig struct {
+	nilExtension       bool
+	dateTimeFormats    []string
+	allowUnknownFields bool
+	maxDepth           int
+	maxElements        int
+	prefix             string
+	indent             string
+	omitHeader         bool
+	useI4              bool
+	tagKey             string
+	caseInsensitive    bool
+	byteSliceAsArray   bool
+	location           *time.Location
+	timeLocation       *time.Location
+	strict             bool
+	emptyNumericAsZero bool
+	arrayAsStruct      bool
+	weakTyping         bool
+	trackFields        bool
+}
+
+// NewCodec returns a new XML-RPC codec configured with the given options,
+// such as func(c *Codec) { c.OmitHeader(true) }, which call the codec settings.
+// The codec is used as a template by the client and server which never modify it.
+func NewCodec(options ...func(*Codec)) *Codec {
+	c := newCodec()
+	for _, opt := range options {
+		opt(c)
+	}
+	return c
+}
+
+// OmitHeader omit the XML declaration from requests and responses.
+func (c *Codec) OmitHeader(omit bool) {
+	c.cfg.omitHeader = omit
+}
+
+// SetDefaultLocation configure the location of decoded dateTime values without a timezone.
+// Defaults to UTC.
+func (c *Codec) SetDefaultLocation(loc *time.Location) {
+	c.cfg.location = loc
+}
+
+// TrackPresentFields record the names of the struct members in each decoded value to tell absent members
+// from members with zero values. The names are available from Decoder.PresentFields.
+func (c *Codec) TrackPresentFields(enable bool) {
+	c.cfg.trackFields = enable
+}
+
+// EnableNilExtension write empty values as <nil/>.
+// The extension is not part of the XML-RPC spec and may be rejected by strict servers.
+func (c *Codec) EnableNilExtension(enable bool) {
+	c.cfg.nilExtension = enable
+}
+
+// UseI4 write 32-bit integers with the <i4> tag instead of <int> for clients which only understand <i4>.
+func (c *Codec) UseI4(use bool) {
+	c.cfg.useI4 = use
+}
+
+// SetTagKey use the given struct tag key to name members instead of "rpc".
+// The json tag is still consulted when a field has no tag for the key.
+func (c *Codec) SetTagKey(key string) {
+	c.cfg.tagKey = key
+}
+
+// ByteSliceAsArray write []byte as an array of ints instead of base64.
+// Arrays of ints are always accepted when decoding into a []byte.
+func (c *Codec) ByteSliceAsArray(enable bool) {
+	c.cfg.byteSliceAsArray = enable
+}
+
+// ArrayAsStruct decode arrays into structs by assigning the elements to the fields in declaration order.
+// Extra elements are an error unless unknown fields are allowed.
+func (c *Codec) ArrayAsStruct(enable bool) {
+	c.cfg.arrayAsStruct = enable
+}
+
+// WeakTyping decode strings into numeric and boolean values and numbers into strings
+// for servers which do not send values with the expected types.
+func (c *Codec) WeakTyping(enable bool) {
+	c.cfg.weakTyping = enable
+}
+
+// EncodeTimesIn convert dateTime values to the location, such as time.UTC, before writing them.
+// The dateTime format has no zone so the same instant is otherwise written differently for each location.
+// A nil location writes each value in its own location.
+func (c *Codec) EncodeTimesIn(loc *time.Location) {
+	c.cfg.timeLocation = loc
+}
+
+// StrictMode reject the <nil/> and <i8> extension value tags when decoding
+// for conformance with the base XML-RPC spec. Such values fail with an InvalidRequest fault when enabled.
+func (c *Codec) StrictMode(enable bool) {
+	c.cfg.strict = enable
+}
+
+// EmptyNumericAsZero decode numeric values with only whitespace content such as <int> </int> as zero.
+// By default such values fail with an InvalidRequest fault. Empty elements such as <int/> or <int></int>
+// are always zero.
+func (c *Codec) EmptyNumericAsZero(enable bool) {
+	c.cfg.emptyNumericAsZero = enable
+}
+
+// AddDateTimeFormat register an additional layout for parsing dateTime.iso8601 values.
+// Registered layouts are tried in order before the default layouts.
+func (c *Codec) AddDateTimeFormat(layout string) {
+	c.cfg.dateTimeFormats = append(c.cfg.dateTimeFormats, layout)
+}
+
+// AllowUnknownFields ignore struct members without a matching field when decoding.
+// By default unknown members are reported as an error.
+func (c *Codec) AllowUnknownFields(allow bool) {
+	c.cfg.allowUnknownFields = allow
+}
+
+// DisallowUnknownFields report struct members without a matching field as an error when decoding,
+// which is the default, or ignore them when disabled. It is the inverse of AllowUnknownFields.
+func (c *Codec) DisallowUnknownFields(disallow bool) {
+	c.cfg.allowUnknownFields = !disallow
+}
+
+// MatchCaseInsensitive match struct members to fields ignoring case when decoding.
+// Exact matches are preferred when available.
+func (c *Codec) MatchCaseInsensitive(enable bool) {
+	c.cfg.caseInsensitive = enable
+}
+
+// SetMaxDepth limit how deeply arrays and structs may be nested when decoding.
+// Input exceeding the limit fails with a MalformedInput fault. Defaults to 64 when not positive.
+func (c *Codec) SetMaxDepth(depth int) {
+	c.cfg.maxDepth = depth
+}
+
+// SetMaxElements limit the number of values decoded from a single input.
+// Input exceeding the limit fails with a MalformedInput fault. Zero means no limit.
+func (c *Codec) SetMaxElements(n int) {
+	c.cfg.maxElements = n
+}
+
+// SetIndent write each nested element on a new line starting with the prefix
+// followed by one or more copies of indent according to the nesting depth.
+// Values are written compactly by default.
+func (c *Codec) SetIndent(prefix, indent string) {
+	c.cfg.prefix = prefix
+	c.cfg.indent = indent
 }
 
 // withCodec acquires a codec from a pool for the callback and release when done.
 // The callback function should not hold a reference to the codec when it completes.
 func withCodec(f func(*Codec) error) error {
-	c := codecPool.Get().(*Codec)
+	return withPooledCodec(codecPool, f)
+}
+
+// withPooledCodec acquires a codec from the given pool for the callback and release when done.
+func withPooledCodec(pool *sync.Pool, f func(*Codec) error) error {
+	c := pool.Get().(*Codec)
 	err := f(c)
-	codecPool.Put(c)
+	pool.Put(c)
 	return err
 }
 
+// newCodecPool returns a pool of codecs with the configuration of the given codec at the time of the call.
+// Later changes to the codec do not affect the pool
+func newCodecPool(codec *Codec) *sync.Pool {
+	cfg := codec.cfg.snapshot()
+	return &sync.Pool{
+		New: func() interface{} {
+			c := newCodec()
+			c.cfg = cfg
+			return c
+		},
+	}
+}
+
 // newCodec return an XML-RPC codec for reading/writing requests and responses
 func newCodec() *Codec {
-	return &Codec{
+	c := &Codec{
 		rd: newReader(emptyReader),
 		wr: newWriter(ioutil.Discard),
 	}
+	c.rd.cfg = &c.cfg
+	c.wr.cfg = &c.cfg
+	return c
+}
+
+// clone returns a new codec with the same configuration
+func (c *Codec) clone() *Codec {
+	codec := newCodec()
+	codec.cfg = c.cfg.snapshot()
+	return codec
 }
 
 // writeRequest serialzes and writes an XML-RPC methodCall
 func (c *Codec) writeRequest(w io.Writer, method string, params ...interface{}) error {
-	return c.writeRPC(w, makeCall(method, params...))
+	call, err := makeCall(&c.cfg, method, params...)
+	if err != nil {
+		return err
+	}
+	return c.writeRPC(w, call)
 }
 
 // writeResponse serialzes and writes value as valid XML-RPC methodResponse
 func (c *Codec) writeResponse(w io.Writer, params interface{}) error {
-	return c.writeRPC(w, makeResponse(params))
+	res, err := makeResponse(&c.cfg, params)
+	if err != nil {
+		return err
+	}
+	return c.writeRPC(w, res)
 }
 
 // writeRPC serialize a value as XML-RPC
@@ -59,37 +256,74 @@ func (c *Codec) writeRPC(w io.Writer, rpc interface{}) error {
 		err = c.wr.writeCall(v)
 	case methodResponse:
 		err = c.wr.writeResponse(v)
+	case *MethodCall:
+		call := v.call
+		if v.build != nil {
+			call, err = v.build(&c.cfg)
+		}
+		if err == nil {
+			err = c.wr.writeCall(call)
+		}
+	case *MethodResponse:
+		res := v.res
+		if v.build != nil {
+			res, err = v.build(&c.cfg)
+		}
+		if err == nil {
+			err = c.wr.writeResponse(res)
+		}
 	case rpcValue:
 		err = c.wr.writeValue(v)
 	default:
-		err = c.wr.writeValue(makeValue(rpc))
+		var value rpcValue
+		if value, err = makeValue(rpc, &c.cfg); err == nil {
+			err = c.wr.writeValue(value)
+		}
+	}
+	// report the flush error of this write unless the write failed
+	if ferr := c.wr.Flush(); err == nil {
+		err = ferr
 	}
-	c.wr.Flush()
 	return err
 }
 
 // readRequest deserialize an XML-RPC methodCall into the method and params pointer receivers
 func (c *Codec) readRequest(r io.Reader, method *string, params interface{}) error {
+	c.rd.reset(r)
+	return c.decodeRequest(method, params)
+}
+
+// decodeRequest deserialize the next methodCall from the current input
+func (c *Codec) decodeRequest(method *string, params interface{}) error {
 	if err := checkPointer(params); err != nil {
 		return err
 	}
 
 	var call methodCall
-	if err := c.readRPC(r, &call); err != nil {
+	if err := c.decode(&call); err != nil {
 		return err
 	}
 	if call.Method == "" {
 		return InvalidRequest.New("invalid method name '%s'", call.Method)
 	}
 	*method = call.Method
-	return call.rpcParams.writeTo(params)
+	return call.rpcParams.writeTo(params, &c.cfg)
 }
 
 // readResponse deserialize an XML-RPC methodResponse into the params pointer receiver.
 // If the response returned a Fault, the error will be of type xmlrpc.Error
 func (c *Codec) readResponse(r io.Reader, reply interface{}) error {
-	if err := checkPointer(reply); err != nil {
-		return err
+	c.rd.reset(r)
+	return c.decodeResponse(reply)
+}
+
+// readResponseParams deserialize an XML-RPC methodResponse writing each param to the reply pointer at the same position.
+// If the response returned a Fault, the error will be of type Fault
+func (c *Codec) readResponseParams(r io.Reader, replies []interface{}) error {
+	for _, reply := range replies {
+		if err := checkPointer(reply); err != nil {
+			return err
+		}
 	}
 
 	var res methodResponse
@@ -97,24 +331,56 @@ func (c *Codec) readResponse(r io.Reader, reply interface{}) error {
 		return err
 	}
 
-	if !res.Fault.isEmpty() {
-		var fault Fault
-		if err := res.Fault.writeTo(&fault); err != nil {
+	if err := res.fault(&c.cfg); err != nil {
+		return err
+	}
+
+	if len(res.Params) != len(replies) {
+		return InvalidRequest.New("expected %d params in response got %d", len(replies), len(res.Params))
+	}
+	for i := range res.Params {
+		if err := res.Params[i].writeTo(replies[i], &c.cfg); err != nil {
 			return err
 		}
-		return fault
 	}
+	return nil
+}
 
-	return res.rpcParams.writeTo(reply)
+// decodeResponse deserialize the next methodResponse from the current input
+func (c *Codec) decodeResponse(reply interface{}) error {
+	if err := checkPointer(reply); err != nil {
+		return err
+	}
+
+	// the fault is kept in the response instead of returned
+	if res, ok := reply.(*MethodResponse); ok {
+		return c.decode(res)
+	}
+
+	var res methodResponse
+	if err := c.decode(&res); err != nil {
+		return err
+	}
+	if err := res.fault(&c.cfg); err != nil {
+		return err
+	}
+	return res.rpcParams.writeTo(reply, &c.cfg)
 }
 
 // readRPC deserialize a valid XML-RPC input
 func (c *Codec) readRPC(r io.Reader, value interface{}) error {
+	c.rd.reset(r)
+	return c.decode(value)
+}
+
+// decode deserialize the next XML-RPC value or message from the current input
+func (c *Codec) decode(value interface{}) error {
 	if err := checkPointer(value); err != nil {
 		return err
 	}
 
-	c.rd.reset(r)
+	c.rd.count = 0
+	c.present = nil
 	var err error
 	switch v := value.(type) {
 	case *methodCall:
@@ -123,10 +389,23 @@ func (c *Codec) readRPC(r io.Reader, value interface{}) error {
 		err = c.rd.readResponse(v)
 	case *rpcValue:
 		err = c.rd.readValue(v)
+	case *Value:
+		v.cfg = c.config()
+		err = c.rd.readValue(&v.rpc)
+	case *MethodCall:
+		*v = MethodCall{cfg: c.config()}
+		err = c.rd.readCall(&v.call)
+	case *MethodResponse:
+		*v = MethodResponse{cfg: c.config()}
+		err = c.rd.readResponse(&v.res)
 	default:
 		var rpc rpcValue
 		if err = c.rd.readValue(&rpc); err == nil || err == io.EOF {
-			err = rpc.writeTo(value)
+			if c.cfg.trackFields {
+				c.present = make(map[string]bool)
+				rpc.memberNames(c.present, "")
+			}
+			err = rpc.writeTo(value, &c.cfg)
 		}
 	}
 
@@ -138,13 +417,43 @@ func (c *Codec) readRPC(r io.Reader, value interface{}) error {
 		return MalformedInput.New(v.Error())
 	}
 
+	// faults from the XML decoder such as unsupported encodings are wrapped
+	var fault Fault
+	if errors.As(err, &fault) {
+		return fault
+	}
+
 	return err
 }
 
 /// Helper methods ///
 
+// config returns a copy of the codec configuration for values which outlive the codec
+func (c *Codec) config() *codecConfig {
+	cfg := c.cfg.snapshot()
+	return &cfg
+}
+
+// snapshot returns a copy of the configuration which shares no slices with it
+func (cfg *codecConfig) snapshot() codecConfig {
+	c := *cfg
+	c.dateTimeFormats = append([]string(nil), cfg.dateTimeFormats...)
+	return c
+}
+
+// tag returns the struct tag key for naming members
+func (cfg *codecConfig) tag() string {
+	if cfg.tagKey == "" {
+		return "rpc"
+	}
+	return cfg.tagKey
+}
+
 // checkPointer validates that the value is a pointer type
 func checkPointer(v interface{}) error {
+	if v == nil {
+		return InternalError.New("error decoding to value. expected pointer got nil")
+	}
 	refPtrKind := reflect.TypeOf(v).Kind()
 	if refPtrKind != reflect.Ptr {
 		return InternalError.New("error decoding to value. expected pointer got '%s'", refPtrKind)
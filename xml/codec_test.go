@@ -2,9 +2,17 @@ package xml
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -14,11 +22,13 @@ var (
 		// boolean
 		"<boolean>1</boolean>": true,
 		// numbers
-		"<int>-5</int>":          -5,
-		"<double>1.201</double>": 1.2010,
+		"<int>-5</int>":                -5,
+		"<i8>9223372036854775807</i8>": int64(math.MaxInt64),
+		"<double>1.201</double>":       1.2010,
 		// string
 		"<string>hello</string>":                   "hello",
 		"<string>&lt;&gt;&amp;&#34;&#39;</string>": `<>&"'`,
+		"<string>a&lt;b&gt;c&amp;d</string>":       "a<b>c&d",
 		// empty array
 		"<array><data></data></array>": []interface{}{},
 		// array
@@ -29,6 +39,8 @@ var (
 		"<base64>aGVsbG8=</base64>": []byte("hello"),
 		// datetime
 		"<dateTime.iso8601>20040101T12:30:10</dateTime.iso8601>": time.Date(2004, time.January, 1, 12, 30, 10, 0, time.UTC),
+		// datetime with fractional seconds
+		"<dateTime.iso8601>20040101T12:30:10.5</dateTime.iso8601>": time.Date(2004, time.January, 1, 12, 30, 10, 5e8, time.UTC),
 		// empty struct
 		"<struct></struct>": struct{}{},
 		// struct
@@ -58,14 +70,14 @@ func Test_ReadWriteFixtures(t *testing.T) {
 		xval := fmt.Sprintf("<value>%s</value>", res)
 		b := bytes.NewBufferString("")
 		withCodec(func(c *Codec) error {
-			encoded := makeValue(v)
+			encoded, _ := makeValue(v, &codecConfig{})
 
 			if err := c.writeRPC(b, v); err != nil {
 				assertOk(t, false, err, "encoding error. ", valType)
 			}
 			assertEqual(t, xval, b.String(), "encoding ", valType)
 
-			decoded := makeValue("")
+			decoded, _ := makeValue("", &codecConfig{})
 			if err := c.readRPC(b, &decoded); err != nil {
 				assertOk(t, false, "readRPC value with type '", valType, "' ", err)
 			}
@@ -251,3 +263,1802 @@ func Test_ReadWriteFault(t *testing.T) {
 		return nil
 	})
 }
+
+func Test_ReadNilExtension(t *testing.T) {
+	input := "<value><struct>" +
+		"<member><name>name</name><value><nil/></value></member>" +
+		"<member><name>age</name><value><int>10</int></value></member>" +
+		"</struct></value>"
+
+	withCodec(func(c *Codec) error {
+		var rpc rpcValue
+		if err := c.readRPC(bytes.NewBufferString(input), &rpc); err != nil {
+			assertOk(t, false, "read nil member. ", err)
+		}
+		members := rpc.value.([]rpcEntry)
+		assertEqual(t, nilKind, members[0].Value.kind, "nil member kind")
+		assertOk(t, members[0].Value.isEmpty(), "nil member is empty")
+
+		p := person{Name: "Kofi"}
+		if err := c.readRPC(bytes.NewBufferString(input), &p); err != nil {
+			assertOk(t, false, "decode nil member. ", err)
+		}
+		assertEqual(t, person{Name: "Kofi", Age: 10}, p, "nil member leaves field untouched")
+		return nil
+	})
+}
+
+func Test_WriteNilExtension(t *testing.T) {
+	type optional struct {
+		Count *int `rpc:"count"`
+	}
+
+	b := bytes.NewBufferString("")
+	withCodec(func(c *Codec) error {
+		c.writeRPC(b, optional{})
+		return nil
+	})
+	assertEqual(t, "<value><struct><member><name>count</name><value></value></member></struct></value>", b.String(), "nil pointer as empty value")
+
+	b.Reset()
+	codec := NewCodec(func(c *Codec) { c.EnableNilExtension(true) })
+	codec.writeRPC(b, optional{})
+	assertEqual(t, "<value><struct><member><name>count</name><value><nil/></value></member></struct></value>", b.String(), "nil pointer as <nil/>")
+}
+
+func Test_ReadI8Extension(t *testing.T) {
+	input := "<value><i8>9223372036854775807</i8></value>"
+
+	withCodec(func(c *Codec) error {
+		var rpc rpcValue
+		if err := c.readRPC(bytes.NewBufferString(input), &rpc); err != nil {
+			assertOk(t, false, "read i8. ", err)
+		}
+		assertEqual(t, rpcValue{value: int64(math.MaxInt64), kind: intKind}, rpc, "i8 value")
+
+		var n int64
+		if err := c.readRPC(bytes.NewBufferString(input), &n); err != nil {
+			assertOk(t, false, "decode i8. ", err)
+		}
+		assertEqual(t, int64(math.MaxInt64), n, "decode i8 into int64")
+
+		var small int8
+		err := c.readRPC(bytes.NewBufferString(input), &small)
+		assertNotEqual(t, nil, err, "i8 overflows int8")
+		return nil
+	})
+}
+
+func Test_WriteI8Extension(t *testing.T) {
+	fixtures := map[string]interface{}{
+		"<int>2147483647</int>":  int64(math.MaxInt32),
+		"<i8>2147483648</i8>":    int64(math.MaxInt32 + 1),
+		"<int>-2147483648</int>": int64(math.MinInt32),
+		"<i8>-2147483649</i8>":   int64(math.MinInt32 - 1),
+		"<i8>4294967295</i8>":    uint32(math.MaxUint32),
+		"<int>255</int>":         uint8(255),
+	}
+
+	withCodec(func(c *Codec) error {
+		for res, v := range fixtures {
+			b := bytes.NewBufferString("")
+			if err := c.writeRPC(b, v); err != nil {
+				assertOk(t, false, "encode integer. ", err)
+			}
+			assertEqual(t, "<value>"+res+"</value>", b.String(), "encode ", v)
+		}
+
+		err := c.writeRPC(bytes.NewBufferString(""), uint64(math.MaxUint64))
+		assertNotEqual(t, nil, err, "uint64 overflows i8")
+		return nil
+	})
+}
+
+func Test_CustomDateTimeFormat(t *testing.T) {
+	input := "<value><dateTime.iso8601>2004-01-01 12:30:10</dateTime.iso8601></value>"
+
+	var dt time.Time
+	withCodec(func(c *Codec) error {
+		err := c.readRPC(bytes.NewBufferString(input), &dt)
+		assertNotEqual(t, nil, err, "default formats reject custom layout")
+		return nil
+	})
+
+	codec := NewCodec()
+	codec.AddDateTimeFormat("2006-01-02 15:04:05")
+	if err := codec.readRPC(bytes.NewBufferString(input), &dt); err != nil {
+		assertOk(t, false, "decode custom layout. ", err)
+	}
+	assertEqual(t, time.Date(2004, time.January, 1, 12, 30, 10, 0, time.UTC), dt, "decode custom layout")
+}
+
+func Test_FractionalSeconds(t *testing.T) {
+	fixtures := map[string]time.Time{
+		"20040101T12:30:10.500":          time.Date(2004, time.January, 1, 12, 30, 10, 5e8, time.UTC),
+		"2004-01-01T12:30:10.123456789Z": time.Date(2004, time.January, 1, 12, 30, 10, 123456789, time.UTC),
+	}
+
+	for s, expected := range fixtures {
+		var dt time.Time
+		input := fmt.Sprintf("<value><dateTime.iso8601>%s</dateTime.iso8601></value>", s)
+		withCodec(func(c *Codec) error {
+			return c.readRPC(bytes.NewBufferString(input), &dt)
+		})
+		assertEqual(t, expected.Nanosecond(), dt.Nanosecond(), "decode nanoseconds ", s)
+	}
+
+	testTime := time.Date(2005, 12, 24, 3, 30, 5, 123456789, time.UTC)
+	var dt time.Time
+	pipeEncodeDecode(t, testTime, &dt)
+	assertEqual(t, testTime, dt, "round-trip nanoseconds")
+}
+
+func Test_OmitEmptyTag(t *testing.T) {
+	type profile struct {
+		Name    string   `rpc:"name,omitempty"`
+		Age     int      `rpc:"age,omitempty"`
+		Tags    []string `rpc:"tags,omitempty"`
+		Comment *string  `rpc:",omitempty"`
+	}
+
+	b := bytes.NewBufferString("")
+	withCodec(func(c *Codec) error {
+		return c.writeRPC(b, profile{Age: 10})
+	})
+	assertEqual(t, "<value><struct><member><name>age</name><value><int>10</int></value></member></struct></value>", b.String(), "omit empty fields")
+
+	comment := "hi"
+	p1 := profile{Name: "Kofi", Tags: []string{"a"}, Comment: &comment}
+	b.Reset()
+	withCodec(func(c *Codec) error {
+		return c.writeRPC(b, p1)
+	})
+	assertEqual(t, "<value><struct><member><name>name</name><value><string>Kofi</string></value></member>"+
+		"<member><name>tags</name><value><array><data><value><string>a</string></value></data></array></value></member>"+
+		"<member><name>Comment</name><value><string>hi</string></value></member></struct></value>", b.String(), "include non-empty fields")
+
+	var p2 profile
+	pipeEncodeDecode(t, profile{Name: "Kofi"}, &p2)
+	assertEqual(t, profile{Name: "Kofi"}, p2, "decode omitempty field names")
+}
+
+func Test_SkipFieldTag(t *testing.T) {
+	type account struct {
+		Name   string `rpc:"name"`
+		Secret string `rpc:"-"`
+	}
+
+	b := bytes.NewBufferString("")
+	withCodec(func(c *Codec) error {
+		return c.writeRPC(b, account{Name: "Kofi", Secret: "pass"})
+	})
+	assertEqual(t, "<value><struct><member><name>name</name><value><string>Kofi</string></value></member></struct></value>", b.String(), "skip field on encode")
+
+	input := "<value><struct><member><name>Secret</name><value><string>pass</string></value></member></struct></value>"
+	var a account
+	err := withCodec(func(c *Codec) error {
+		return c.readRPC(bytes.NewBufferString(input), &a)
+	})
+	assertNotEqual(t, nil, err, "reject skipped field on decode")
+	assertEqual(t, "", a.Secret, "skipped field not written")
+}
+
+// blob marshals itself as a base64 value
+type blob struct {
+	data string
+}
+
+func (b blob) MarshalRPC() (interface{}, error) {
+	if b.data == "" {
+		return nil, InvalidParams.New("empty blob")
+	}
+	return []byte(b.data), nil
+}
+
+func Test_Marshaler(t *testing.T) {
+	type document struct {
+		Content blob `rpc:"content"`
+	}
+
+	b := bytes.NewBufferString("")
+	withCodec(func(c *Codec) error {
+		return c.writeRPC(b, document{Content: blob{data: "hello"}})
+	})
+	assertEqual(t, "<value><struct><member><name>content</name><value><base64>aGVsbG8=</base64></value></member></struct></value>", b.String(), "custom marshaler")
+
+	err := withCodec(func(c *Codec) error {
+		return c.writeRPC(bytes.NewBufferString(""), document{})
+	})
+	assertEqual(t, InvalidParams.New("empty blob"), err, "custom marshaler error")
+}
+
+// percent validates the decoded value is within range
+type percent int
+
+func (p *percent) UnmarshalRPC(value interface{}) error {
+	n, ok := value.(int)
+	if !ok || n < 0 || n > 100 {
+		return InvalidParams.New("invalid percent %v", value)
+	}
+	*p = percent(n)
+	return nil
+}
+
+func Test_Unmarshaler(t *testing.T) {
+	type progress struct {
+		Done percent `rpc:"done"`
+	}
+
+	var p progress
+	pipeEncodeDecode(t, map[string]int{"done": 50}, &p)
+	assertEqual(t, percent(50), p.Done, "custom unmarshaler")
+
+	err := withCodec(func(c *Codec) error {
+		input := "<value><struct><member><name>done</name><value><int>150</int></value></member></struct></value>"
+		return c.readRPC(bytes.NewBufferString(input), &p)
+	})
+	assertEqual(t, InvalidParams.New("invalid percent 150"), err, "custom unmarshaler error")
+}
+
+func Test_AllowUnknownFields(t *testing.T) {
+	input := "<value><struct><member><name>name</name><value><string>Kofi</string></value></member>" +
+		"<member><name>email</name><value><string>kofi@example.com</string></value></member></struct></value>"
+
+	var p person
+	err := withCodec(func(c *Codec) error {
+		return c.readRPC(bytes.NewBufferString(input), &p)
+	})
+	assertNotEqual(t, nil, err, "strict decode rejects unknown member")
+
+	p = person{}
+	codec := NewCodec()
+	codec.AllowUnknownFields(true)
+	err = codec.readRPC(bytes.NewBufferString(input), &p)
+	assertEqual(t, nil, err, "lenient decode ignores unknown member")
+	assertEqual(t, person{Name: "Kofi"}, p, "lenient decode")
+}
+
+func Test_DisallowUnknownFields(t *testing.T) {
+	input := "<value><struct><member><name>name</name><value><string>Kofi</string></value></member>" +
+		"<member><name>email</name><value><string>kofi@example.com</string></value></member></struct></value>"
+
+	var p person
+	codec := NewCodec()
+	codec.DisallowUnknownFields(true)
+	err := codec.readRPC(bytes.NewBufferString(input), &p)
+	assertNotEqual(t, nil, err, "disallow unknown fields rejects unknown member")
+
+	codec.DisallowUnknownFields(false)
+	p = person{}
+	err = codec.readRPC(bytes.NewBufferString(input), &p)
+	assertEqual(t, nil, err, "allowed unknown fields no error")
+	assertEqual(t, person{Name: "Kofi"}, p, "allowed unknown fields ignores unknown member")
+
+	codec = NewCodec()
+	codec.AllowUnknownFields(true)
+	codec.DisallowUnknownFields(true)
+	err = codec.readRPC(bytes.NewBufferString(input), &p)
+	assertNotEqual(t, nil, err, "last setting of unknown fields applies")
+}
+
+func Test_NonStringMapKeys(t *testing.T) {
+	fixtures := map[string]interface{}{
+		"3":    map[int]string{3: "three"},
+		"7":    map[uint8]string{7: "seven"},
+		"1.5":  map[float64]string{1.5: "one and half"},
+		"true": map[bool]string{true: "yes"},
+		"5m0s": map[time.Duration]string{5 * time.Minute: "stringer"},
+	}
+
+	for name, v := range fixtures {
+		b := bytes.NewBufferString("")
+		withCodec(func(c *Codec) error {
+			return c.writeRPC(b, v)
+		})
+		assertOk(t, strings.Contains(b.String(), "<name>"+name+"</name>"), "map key name ", name)
+	}
+}
+
+func Test_ReadSplitText(t *testing.T) {
+	fixtures := map[string]string{
+		"<value><string>a&lt;b&gt;c&amp;d</string></value>":          "a<b>c&d",
+		"<value><string>a<![CDATA[<b>]]>c</string></value>":          "a<b>c",
+		"<value>unwrapped <![CDATA[&]]> text</value>":                "unwrapped & text",
+		"<value><string><![CDATA[x]]><![CDATA[y]]></string></value>": "xy",
+	}
+
+	for input, expected := range fixtures {
+		var s string
+		err := withCodec(func(c *Codec) error {
+			return c.readRPC(bytes.NewBufferString(input), &s)
+		})
+		assertEqual(t, nil, err, "decode split text ", input)
+		assertEqual(t, expected, s, "decode split text ", input)
+	}
+}
+
+func Test_MaxDepth(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat("<value><array><data>", depth-1) + "<value><int>1</int></value>" +
+			strings.Repeat("</data></array></value>", depth-1)
+	}
+
+	withCodec(func(c *Codec) error {
+		var rpc rpcValue
+		err := c.readRPC(bytes.NewBufferString(nested(defaultMaxDepth)), &rpc)
+		assertEqual(t, nil, err, "decode within default depth")
+
+		err = c.readRPC(bytes.NewBufferString(nested(defaultMaxDepth+1)), &rpc)
+		fault, ok := err.(Fault)
+		assertOk(t, ok, "expect fault beyond default depth")
+		assertEqual(t, int(MalformedInput), fault.Code, "malformed input beyond default depth")
+
+		// depth is reset for each read
+		err = c.readRPC(bytes.NewBufferString(nested(defaultMaxDepth)), &rpc)
+		assertEqual(t, nil, err, "decode after exceeding depth")
+		return nil
+	})
+
+	codec := NewCodec()
+	codec.SetMaxDepth(3)
+	var rpc rpcValue
+	err := codec.readRPC(bytes.NewBufferString(nested(3)), &rpc)
+	assertEqual(t, nil, err, "decode within custom depth")
+	err = codec.readRPC(bytes.NewBufferString(nested(4)), &rpc)
+	assertNotEqual(t, nil, err, "error beyond custom depth")
+}
+
+func Test_MaxElements(t *testing.T) {
+	input := createXML(100, "value")
+
+	var rpc rpcValue
+	err := withCodec(func(c *Codec) error {
+		return c.readRPC(bytes.NewBufferString(input), &rpc)
+	})
+	assertEqual(t, nil, err, "no limit by default")
+
+	codec := NewCodec()
+	codec.SetMaxElements(50)
+	err = codec.readRPC(bytes.NewBufferString(input), &rpc)
+	fault, ok := err.(Fault)
+	assertOk(t, ok, "expect fault beyond max elements")
+	assertEqual(t, int(MalformedInput), fault.Code, "malformed input beyond max elements")
+
+	// count is reset for each read
+	err = codec.readRPC(bytes.NewBufferString(createXML(10, "value")), &rpc)
+	assertEqual(t, nil, err, "decode within max elements")
+}
+
+func Test_MarshalUnmarshal(t *testing.T) {
+	data, err := Marshal(42)
+	assertEqual(t, nil, err, "marshal int no error")
+	assertEqual(t, "<value><int>42</int></value>", string(data), "marshal int")
+
+	var n int
+	err = Unmarshal(data, &n)
+	assertEqual(t, nil, err, "unmarshal int no error")
+	assertEqual(t, 42, n, "unmarshal int")
+
+	data, _ = Marshal("hello")
+	var s string
+	Unmarshal(data, &s)
+	assertEqual(t, "hello", s, "marshal string")
+
+	p1 := person{Name: "Kofi", Age: 10}
+	data, err = Marshal(p1)
+	assertEqual(t, nil, err, "marshal struct no error")
+	assertEqual(t, "<value><struct><member><name>name</name><value><string>Kofi</string></value></member>"+
+		"<member><name>age</name><value><int>10</int></value></member></struct></value>", string(data), "marshal struct")
+	var p2 person
+	err = Unmarshal(data, &p2)
+	assertEqual(t, nil, err, "unmarshal struct no error")
+	assertEqual(t, p1, p2, "unmarshal struct")
+
+	data, _ = Marshal([]person{p1, p1})
+	var people []person
+	err = Unmarshal(data, &people)
+	assertEqual(t, nil, err, "unmarshal slice no error")
+	assertEqual(t, []person{p1, p1}, people, "unmarshal slice")
+
+	err = Unmarshal(data, people)
+	assertNotEqual(t, nil, err, "unmarshal requires pointer")
+	err = Unmarshal(data, nil)
+	assertNotEqual(t, nil, err, "unmarshal requires non-nil pointer")
+}
+
+func Test_EncoderDecoder(t *testing.T) {
+	b := bytes.NewBufferString("")
+	enc := NewEncoder(b)
+	enc.Encode(1)
+	enc.Encode("two")
+	enc.Encode(person{Name: "Kofi", Age: 3})
+
+	var n int
+	var s string
+	var p person
+	dec := NewDecoder(b)
+	assertEqual(t, nil, dec.Decode(&n), "decode first value")
+	assertEqual(t, nil, dec.Decode(&s), "decode second value")
+	assertEqual(t, nil, dec.Decode(&p), "decode third value")
+	assertEqual(t, 1, n, "first value")
+	assertEqual(t, "two", s, "second value")
+	assertEqual(t, person{Name: "Kofi", Age: 3}, p, "third value")
+	assertEqual(t, io.EOF, dec.Decode(&n), "end of input")
+
+	b.Reset()
+	enc = NewEncoder(b, func(c *Codec) { c.EnableNilExtension(true) })
+	enc.EncodeRequest("service.Do", nil)
+	assertEqual(t, xml.Header+"<methodCall><methodName>service.Do</methodName><params><param>"+
+		"<value><nil/></value></param></params></methodCall>", b.String(), "encode request")
+
+	b.Reset()
+	withCodec(func(c *Codec) error {
+		return c.writeResponse(b, InvalidParams.New("bad"))
+	})
+	err := NewDecoder(b).DecodeResponse(&n)
+	assertEqual(t, InvalidParams.New("bad"), err, "decode fault response")
+}
+
+func Test_RegisterFaultCode(t *testing.T) {
+	// the returned code can be kept in a variable of the exported type
+	var notFound FaultCode
+	notFound, err := RegisterFaultCode(404, "record not found")
+	assertEqual(t, nil, err, "register custom code")
+	assertOk(t, errors.Is(notFound.New("user 7"), notFound), "match custom code")
+	assertEqual(t, Fault{Code: 404, Message: "record not found"}, notFound.New(""), "custom code default message")
+	assertEqual(t, Fault{Code: 404, Message: "user 7"}, notFound.New("user %d", 7), "custom code message")
+
+	_, err = RegisterFaultCode(int(InvalidParams), "bad params")
+	assertNotEqual(t, nil, err, "reject built-in code")
+	assertEqual(t, "invalid method parameters", InvalidParams.String(), "built-in message unchanged")
+
+	_, err = RegisterFaultCode(-32099, "server error")
+	assertNotEqual(t, nil, err, "reject reserved code")
+}
+
+func Test_DoublePrecision(t *testing.T) {
+	fixtures := map[string]float64{
+		"<double>0.1</double>":                     0.1,
+		"<double>0.000000001</double>":             1e-9,
+		"<double>1.23456789012</double>":           1.23456789012,
+		"<double>100000000000000000000.0</double>": 1e20,
+		"<double>-3.0</double>":                    -3,
+	}
+
+	for res, v := range fixtures {
+		b := bytes.NewBufferString("")
+		withCodec(func(c *Codec) error {
+			return c.writeRPC(b, v)
+		})
+		assertEqual(t, "<value>"+res+"</value>", b.String(), "encode double ", v)
+
+		var d float64
+		pipeEncodeDecode(t, v, &d)
+		assertEqual(t, v, d, "round-trip double ", v)
+	}
+
+	b := bytes.NewBufferString("")
+	withCodec(func(c *Codec) error {
+		return c.writeRPC(b, float32(0.1))
+	})
+	assertEqual(t, "<value><double>0.1</double></value>", b.String(), "encode float32")
+}
+
+func Test_Indent(t *testing.T) {
+	codec := NewCodec()
+	codec.SetIndent("", "  ")
+
+	type team struct {
+		Name    string   `rpc:"name"`
+		Members []string `rpc:"members"`
+	}
+	in := team{Name: "a & b", Members: []string{"Kofi", "Ama"}}
+
+	b := bytes.NewBufferString("")
+	if err := codec.writeRPC(b, in); err != nil {
+		assertOk(t, false, "encode indented. ", err)
+	}
+	expected := `<value>
+  <struct>
+    <member>
+      <name>name</name>
+      <value>
+        <string>a &amp; b</string>
+      </value>
+    </member>
+    <member>
+      <name>members</name>
+      <value>
+        <array>
+          <data>
+            <value>
+              <string>Kofi</string>
+            </value>
+            <value>
+              <string>Ama</string>
+            </value>
+          </data>
+        </array>
+      </value>
+    </member>
+  </struct>
+</value>`
+	assertEqual(t, expected, b.String(), "encode indented")
+
+	var out team
+	if err := codec.readRPC(b, &out); err != nil {
+		assertOk(t, false, "decode indented. ", err)
+	}
+	assertEqual(t, in, out, "decode indented")
+
+	b.Reset()
+	codec.writeResponse(b, 1)
+	assertEqual(t, xml.Header+"<methodResponse>\n  <params>\n    <param>\n      <value>\n        <int>1</int>\n      </value>\n    </param>\n  </params>\n</methodResponse>", b.String(), "encode indented response")
+}
+
+func Test_OmitHeader(t *testing.T) {
+	codec := NewCodec(func(c *Codec) { c.OmitHeader(true) })
+
+	b := bytes.NewBufferString("")
+	codec.writeRequest(b, "service.Do", 1)
+	assertEqual(t, "<methodCall><methodName>service.Do</methodName><params><param>"+
+		"<value><int>1</int></value></param></params></methodCall>", b.String(), "request without header")
+
+	var method string
+	var n int
+	err := codec.readRequest(b, &method, &n)
+	assertEqual(t, nil, err, "decode request without header")
+	assertEqual(t, 1, n, "decode request without header")
+
+	b.Reset()
+	codec.writeResponse(b, 1)
+	assertEqual(t, "<methodResponse><params><param><value><int>1</int></value></param></params></methodResponse>", b.String(), "response without header")
+}
+
+func Test_UseI4(t *testing.T) {
+	codec := NewCodec()
+	b := bytes.NewBufferString("")
+	codec.writeRPC(b, 7)
+	assertEqual(t, "<value><int>7</int></value>", b.String(), "encode int by default")
+
+	codec.UseI4(true)
+	b.Reset()
+	codec.writeRPC(b, []int64{7, math.MaxInt64})
+	assertEqual(t, "<value><array><data><value><i4>7</i4></value><value><i8>9223372036854775807</i8></value></data></array></value>", b.String(), "encode i4")
+
+	var n []int64
+	err := codec.readRPC(b, &n)
+	assertEqual(t, nil, err, "decode i4 no error")
+	assertEqual(t, []int64{7, math.MaxInt64}, n, "decode i4")
+}
+
+func Test_BooleanSpellings(t *testing.T) {
+	fixtures := map[string]bool{
+		"1": true, "true": true, "True": true, "TRUE": true, "t": true, "yes": true, "YES": true, "on": true,
+		"0": false, "false": false, "False": false, "f": false, "no": false, "No": false, "off": false, " 1 ": true,
+	}
+
+	for s, expected := range fixtures {
+		b := !expected
+		err := Unmarshal([]byte("<value><boolean>"+s+"</boolean></value>"), &b)
+		assertEqual(t, nil, err, "decode boolean no error ", s)
+		assertEqual(t, expected, b, "decode boolean ", s)
+	}
+
+	var b bool
+	err := Unmarshal([]byte("<value><boolean>maybe</boolean></value>"), &b)
+	assertNotEqual(t, nil, err, "reject invalid boolean")
+
+	data, _ := Marshal(true)
+	assertEqual(t, "<value><boolean>1</boolean></value>", string(data), "encode boolean as 1")
+}
+
+func Test_Base64ToString(t *testing.T) {
+	input := []byte("<value><base64>aGVsbG8=</base64></value>")
+
+	var b []byte
+	err := Unmarshal(input, &b)
+	assertEqual(t, nil, err, "decode base64 to bytes no error")
+	assertEqual(t, []byte("hello"), b, "decode base64 to bytes")
+
+	var s string
+	err = Unmarshal(input, &s)
+	assertEqual(t, nil, err, "decode base64 to string no error")
+	assertEqual(t, "hello", s, "decode base64 to string")
+
+	type message struct {
+		Body string `rpc:"body"`
+	}
+	var m message
+	err = Unmarshal([]byte("<value><struct><member><name>body</name><value><base64>aGVsbG8=</base64></value></member></struct></value>"), &m)
+	assertEqual(t, nil, err, "decode base64 to string field no error")
+	assertEqual(t, "hello", m.Body, "decode base64 to string field")
+}
+
+func Test_TimePointer(t *testing.T) {
+	type event struct {
+		Start *time.Time `rpc:"start"`
+		End   *time.Time `rpc:"end"`
+	}
+
+	start := time.Date(2020, time.March, 1, 10, 30, 0, 0, time.UTC)
+	for _, codec := range []*Codec{NewCodec(), NewCodec(func(c *Codec) { c.EnableNilExtension(true) })} {
+		b := bytes.NewBufferString("")
+		err := codec.writeRPC(b, event{Start: &start})
+		assertEqual(t, nil, err, "encode time pointer no error")
+		assertOk(t, strings.Contains(b.String(), "<dateTime.iso8601>20200301T10:30:00</dateTime.iso8601>"), "encode time pointer as dateTime", b.String())
+
+		var e event
+		err = codec.readRPC(b, &e)
+		assertEqual(t, nil, err, "decode time pointer no error")
+		assertOk(t, e.Start != nil, "decode allocates time pointer")
+		assertOk(t, start.Equal(*e.Start), "decode time pointer value")
+		assertOk(t, e.End == nil, "decode nil time pointer")
+	}
+}
+
+func Test_EncodeEmbeddedStruct(t *testing.T) {
+	type Base struct {
+		ID    int    `rpc:"id"`
+		Notes string `rpc:"notes,omitempty"`
+	}
+	type User struct {
+		Base
+		Name string `rpc:"name"`
+	}
+
+	b := bytes.NewBufferString("")
+	withCodec(func(c *Codec) error {
+		return c.writeRPC(b, User{Base: Base{ID: 7}, Name: "Kofi"})
+	})
+	assertEqual(t, "<value><struct>"+
+		"<member><name>id</name><value><int>7</int></value></member>"+
+		"<member><name>name</name><value><string>Kofi</string></value></member>"+
+		"</struct></value>", b.String(), "promote embedded struct members")
+
+	type Account struct {
+		*Base `rpc:"base"`
+		Name  string `rpc:"name"`
+	}
+	b.Reset()
+	withCodec(func(c *Codec) error {
+		return c.writeRPC(b, Account{Base: &Base{ID: 7}, Name: "Kofi"})
+	})
+	assertEqual(t, "<value><struct>"+
+		"<member><name>base</name><value><struct><member><name>id</name><value><int>7</int></value></member></struct></value></member>"+
+		"<member><name>name</name><value><string>Kofi</string></value></member>"+
+		"</struct></value>", b.String(), "tagged embedded struct is nested")
+}
+
+func Test_DecodeEmbeddedStruct(t *testing.T) {
+	type Base struct {
+		ID   int    `rpc:"id"`
+		Name string `rpc:"name"`
+	}
+	type User struct {
+		Base
+		Name string `rpc:"name"`
+	}
+	type Account struct {
+		*Base
+		Active bool `rpc:"active"`
+	}
+
+	input := "<value><struct>" +
+		"<member><name>id</name><value><int>7</int></value></member>" +
+		"<member><name>name</name><value><string>Kofi</string></value></member>" +
+		"</struct></value>"
+
+	var u User
+	err := Unmarshal([]byte(input), &u)
+	assertEqual(t, nil, err, "decode embedded struct no error")
+	assertEqual(t, User{Base: Base{ID: 7}, Name: "Kofi"}, u, "decode promoted members with outer field precedence")
+
+	var a Account
+	err = Unmarshal([]byte(input), &a)
+	assertEqual(t, nil, err, "decode embedded pointer no error")
+	assertEqual(t, Account{Base: &Base{ID: 7, Name: "Kofi"}}, a, "decode allocates embedded pointer")
+
+	// a type embedding itself is walked once
+	type Node struct {
+		*Node
+		ID int `rpc:"id"`
+	}
+	var n Node
+	err = Unmarshal([]byte("<value><struct><member><name>id</name><value><int>7</int></value></member></struct></value>"), &n)
+	assertEqual(t, nil, err, "decode self embedding struct no error")
+	assertEqual(t, Node{ID: 7}, n, "decode self embedding struct")
+
+	b := bytes.NewBufferString("")
+	err = withCodec(func(c *Codec) error {
+		return c.writeRPC(b, Node{Node: &Node{ID: 1}, ID: 7})
+	})
+	assertEqual(t, nil, err, "encode self embedding struct no error")
+
+	params, err := expandStruct(Node{ID: 7}, &codecConfig{})
+	assertEqual(t, nil, err, "expand self embedding struct no error")
+	assertEqual(t, []interface{}{7}, params, "expand self embedding struct")
+
+	// a nil embedded pointer to an unexported type cannot be allocated
+	type base struct {
+		ID int `rpc:"id"`
+	}
+	type Wrapper struct {
+		*base
+		Active bool `rpc:"active"`
+	}
+	var w Wrapper
+	err = Unmarshal([]byte(input), &w)
+	assertOk(t, err != nil && strings.Contains(err.Error(), "embedded pointer to unexported struct"), "decode unexported embedded pointer is an error. ", err)
+}
+
+func Test_JSONTagFallback(t *testing.T) {
+	type account struct {
+		Name    string `json:"name"`
+		Email   string `json:"email,omitempty"`
+		Secret  string `json:"-"`
+		Balance int    `json:"balance" rpc:"amount"`
+	}
+
+	b := bytes.NewBufferString("")
+	withCodec(func(c *Codec) error {
+		return c.writeRPC(b, account{Name: "Kofi", Secret: "xyz", Balance: 10})
+	})
+	assertEqual(t, "<value><struct>"+
+		"<member><name>name</name><value><string>Kofi</string></value></member>"+
+		"<member><name>amount</name><value><int>10</int></value></member>"+
+		"</struct></value>", b.String(), "encode with json tag names")
+
+	var a account
+	err := Unmarshal(b.Bytes(), &a)
+	assertEqual(t, nil, err, "decode with json tag names no error")
+	assertEqual(t, account{Name: "Kofi", Balance: 10}, a, "decode with json tag names")
+}
+
+func Test_SetTagKey(t *testing.T) {
+	type account struct {
+		Name    string `xmlrpc:"name"`
+		Balance int    `xmlrpc:"balance" rpc:"amount"`
+		Email   string `json:"email"`
+	}
+
+	codec := NewCodec(func(c *Codec) { c.SetTagKey("xmlrpc") })
+	b := bytes.NewBufferString("")
+	err := codec.writeRPC(b, account{Name: "Kofi", Balance: 10, Email: "k@example.com"})
+	assertEqual(t, nil, err, "encode with custom tag key no error")
+	assertEqual(t, "<value><struct>"+
+		"<member><name>name</name><value><string>Kofi</string></value></member>"+
+		"<member><name>balance</name><value><int>10</int></value></member>"+
+		"<member><name>email</name><value><string>k@example.com</string></value></member>"+
+		"</struct></value>", b.String(), "encode with custom tag key")
+
+	var a account
+	err = codec.readRPC(b, &a)
+	assertEqual(t, nil, err, "decode with custom tag key no error")
+	assertEqual(t, account{Name: "Kofi", Balance: 10, Email: "k@example.com"}, a, "decode with custom tag key")
+}
+
+func Test_MatchCaseInsensitive(t *testing.T) {
+	type user struct {
+		FirstName string `rpc:"firstname"`
+		Name      string `rpc:"Name"`
+		NAME      string `rpc:"NAME"`
+	}
+	input := []byte("<value><struct>" +
+		"<member><name>FirstName</name><value><string>Kofi</string></value></member>" +
+		"<member><name>NAME</name><value><string>upper</string></value></member>" +
+		"<member><name>name</name><value><string>lower</string></value></member>" +
+		"</struct></value>")
+
+	var u user
+	err := Unmarshal(input, &u)
+	assertNotEqual(t, nil, err, "case-sensitive by default")
+
+	codec := NewCodec(func(c *Codec) { c.MatchCaseInsensitive(true) })
+	u = user{}
+	err = codec.readRPC(bytes.NewBuffer(input), &u)
+	assertEqual(t, nil, err, "decode case-insensitive no error")
+	assertEqual(t, user{FirstName: "Kofi", Name: "lower", NAME: "upper"}, u, "decode case-insensitive with exact matches first")
+}
+
+func Test_DecodeInterfaceSlice(t *testing.T) {
+	input := []byte("<value><array><data>" +
+		"<value><int>1</int></value>" +
+		"<value><string>two</string></value>" +
+		"<value><double>3.5</double></value>" +
+		"<value><array><data><value><boolean>1</boolean></value></data></array></value>" +
+		"<value><struct><member><name>n</name><value><i4>5</i4></value></member></struct></value>" +
+		"</data></array></value>")
+
+	var values []interface{}
+	err := Unmarshal(input, &values)
+	assertEqual(t, nil, err, "decode heterogeneous array no error")
+	assertEqual(t, 5, len(values), "decode heterogeneous array length")
+	assertEqual(t, 1, values[0], "decode int element")
+	assertEqual(t, "two", values[1], "decode string element")
+	assertEqual(t, 3.5, values[2], "decode double element")
+	assertEqual(t, []interface{}{true}, values[3], "decode nested array element")
+	assertEqual(t, map[string]interface{}{"n": 5}, values[4], "decode nested struct element")
+}
+
+func Test_DecodeArrayStream(t *testing.T) {
+	input := "<value><array><data>" +
+		"<value><int>10</int></value>" +
+		"<value><int>20</int></value>" +
+		"<value><int>30</int></value>" +
+		"</data></array></value>"
+
+	var indexes, values []int
+	d := NewDecoder(strings.NewReader(input))
+	err := d.DecodeArrayStream(func(i int, elem *Value) error {
+		var n int
+		if err := elem.Decode(&n); err != nil {
+			return err
+		}
+		indexes = append(indexes, i)
+		values = append(values, n)
+		return nil
+	})
+	assertEqual(t, nil, err, "stream array no error")
+	assertEqual(t, []int{0, 1, 2}, indexes, "stream array indexes in order")
+	assertEqual(t, []int{10, 20, 30}, values, "stream array values in order")
+	assertEqual(t, io.EOF, d.DecodeArrayStream(func(int, *Value) error { return nil }), "stream array at end of input")
+
+	stop := fmt.Errorf("stop")
+	calls := 0
+	err = NewDecoder(strings.NewReader(input)).DecodeArrayStream(func(int, *Value) error {
+		calls++
+		return stop
+	})
+	assertEqual(t, stop, err, "stream array stops on callback error")
+	assertEqual(t, 1, calls, "stream array callback not called after error")
+
+	err = NewDecoder(strings.NewReader("<value><int>1</int></value>")).DecodeArrayStream(func(int, *Value) error { return nil })
+	assertNotEqual(t, nil, err, "stream array rejects non-array value")
+}
+
+func Test_ReadComments(t *testing.T) {
+	input := `<?xml version="1.0"?><!-- response -->` +
+		"<methodResponse><params><param><value><struct>" +
+		"<!-- first member --><member><name>name</name><value><string>Ko<!-- split -->fi</string></value></member>" +
+		"<member><!-- second member --><name>age</name><value><int>10</int></value><!-- end --></member>" +
+		"</struct></value></param></params></methodResponse><!-- done -->"
+
+	var p person
+	err := withCodec(func(c *Codec) error {
+		return c.readResponse(strings.NewReader(input), &p)
+	})
+	assertEqual(t, nil, err, "read with comments no error")
+	assertEqual(t, person{Name: "Kofi", Age: 10}, p, "read with comments")
+}
+
+func Test_ReadByteOrderMark(t *testing.T) {
+	for _, input := range []string{
+		"\xef\xbb\xbf<?xml version=\"1.0\"?>\n<methodResponse><params><param><value><int>7</int></value></param></params></methodResponse>",
+		"\xef\xbb\xbf<methodResponse><params><param><value><int>7</int></value></param></params></methodResponse>",
+	} {
+		var n int
+		err := withCodec(func(c *Codec) error {
+			return c.readResponse(strings.NewReader(input), &n)
+		})
+		assertEqual(t, nil, err, "read with byte-order mark no error")
+		assertEqual(t, 7, n, "read with byte-order mark")
+	}
+}
+
+func Test_ReadUnsupportedEncoding(t *testing.T) {
+	response := "<methodResponse><params><param><value><string>caf\xe9</string></value></param></params></methodResponse>"
+
+	var s string
+	err := withCodec(func(c *Codec) error {
+		return c.readResponse(strings.NewReader(`<?xml version="1.0" encoding="ISO-8859-1"?>`+response), &s)
+	})
+	fault, ok := err.(Fault)
+	assertOk(t, ok, "unsupported encoding is a fault")
+	assertEqual(t, int(UnsupportedEncoding), fault.Code, "unsupported encoding fault code")
+	assertEqual(t, "", s, "unsupported encoding leaves reply untouched")
+
+	err = withCodec(func(c *Codec) error {
+		return c.readResponse(strings.NewReader(`<?xml version="1.0" encoding="US-ASCII"?><methodResponse><params><param><value><string>cafe</string></value></param></params></methodResponse>`), &s)
+	})
+	assertEqual(t, nil, err, "ascii encoding no error")
+	assertEqual(t, "cafe", s, "ascii encoding")
+}
+
+func Test_ParseErrorOffset(t *testing.T) {
+	input := "<methodResponse><params><param><value><int>1</int></value></parameter></params></methodResponse>"
+
+	var n int
+	err := withCodec(func(c *Codec) error {
+		return c.readResponse(strings.NewReader(input), &n)
+	})
+	assertNotEqual(t, nil, err, "parse error")
+	assertOk(t, strings.HasSuffix(err.Error(), " at offset 70"), "parse error with offset. ", err)
+}
+
+func Test_FaultData(t *testing.T) {
+	for _, fault := range []Fault{
+		{Code: 1, Message: "no data"},
+		{Code: 2, Message: "with data", Data: map[string]interface{}{"field": "name", "line": 3}},
+	} {
+		b := bytes.NewBufferString("")
+		withCodec(func(c *Codec) error {
+			return c.writeResponse(b, fault)
+		})
+		assertEqual(t, fault.Data != nil, strings.Contains(b.String(), "<name>data</name>"), "encode fault data member")
+
+		var reply string
+		err := withCodec(func(c *Codec) error {
+			return c.readResponse(b, &reply)
+		})
+		assertEqual(t, fault, err, "decode fault data member")
+	}
+
+	// faults with data which cannot be compared with == are matched by code and message
+	type details struct {
+		Fields []string
+	}
+	for _, data := range []interface{}{
+		map[string]interface{}{"field": "name"},
+		details{Fields: []string{"name"}},
+	} {
+		err := fmt.Errorf("call failed: %w", Fault{Code: 3, Message: "invalid", Data: data})
+		assertOk(t, errors.Is(err, Fault{Code: 3}), "match fault data by code")
+		assertOk(t, errors.Is(err, Fault{Code: 3, Message: "invalid"}), "match fault data by code and message")
+		assertOk(t, !errors.Is(err, Fault{Code: 3, Message: "other"}), "fault data message differs")
+		assertOk(t, errors.Is(err, &Fault{Code: 3, Message: "invalid", Data: data}), "match fault data with pointer target")
+		assertOk(t, !errors.Is(err, &Fault{Code: 4, Data: data}), "fault data code differs")
+	}
+}
+
+func Test_EncodeMapSorted(t *testing.T) {
+	m := map[string]interface{}{"zeta": 1, "alpha": 2, "mu": 3, "beta": 4, "omega": 5}
+	expected := "<value><struct>" +
+		"<member><name>alpha</name><value><int>2</int></value></member>" +
+		"<member><name>beta</name><value><int>4</int></value></member>" +
+		"<member><name>mu</name><value><int>3</int></value></member>" +
+		"<member><name>omega</name><value><int>5</int></value></member>" +
+		"<member><name>zeta</name><value><int>1</int></value></member>" +
+		"</struct></value>"
+
+	for i := 0; i < 10; i++ {
+		b := bytes.NewBufferString("")
+		withCodec(func(c *Codec) error {
+			return c.writeRPC(b, m)
+		})
+		assertEqual(t, expected, b.String(), "encode map with sorted members")
+	}
+
+	b := bytes.NewBufferString("")
+	withCodec(func(c *Codec) error {
+		return c.writeRPC(b, map[int]bool{10: true, 2: false})
+	})
+	assertEqual(t, "<value><struct>"+
+		"<member><name>10</name><value><boolean>1</boolean></value></member>"+
+		"<member><name>2</name><value><boolean>0</boolean></value></member>"+
+		"</struct></value>", b.String(), "encode map sorted by member name")
+}
+
+func Test_WriteNaNInf(t *testing.T) {
+	for _, f := range []interface{}{math.Inf(1), math.Inf(-1), math.NaN(), float32(math.Inf(1))} {
+		err := withCodec(func(c *Codec) error {
+			return c.writeRPC(bytes.NewBufferString(""), []interface{}{1.5, f})
+		})
+		assertOk(t, errors.Is(err, InvalidParams), "reject double ", f)
+	}
+}
+
+func Test_DecodePointerFields(t *testing.T) {
+	type nested struct {
+		Name string `rpc:"name"`
+	}
+	type optional struct {
+		Count  *int    `rpc:"count"`
+		Nested *nested `rpc:"nested"`
+		Label  *string `rpc:"label"`
+	}
+
+	input := []byte("<value><struct>" +
+		"<member><name>count</name><value><int>3</int></value></member>" +
+		"<member><name>nested</name><value><struct><member><name>name</name><value><string>Kofi</string></value></member></struct></value></member>" +
+		"<member><name>label</name><value><nil/></value></member>" +
+		"</struct></value>")
+
+	var o optional
+	err := Unmarshal(input, &o)
+	assertEqual(t, nil, err, "decode pointer fields no error")
+	assertOk(t, o.Count != nil && *o.Count == 3, "decode allocates *int field")
+	assertOk(t, o.Nested != nil && o.Nested.Name == "Kofi", "decode allocates *struct field")
+	assertOk(t, o.Label == nil, "decode leaves nil pointer for nil value")
+
+	var n *int
+	err = Unmarshal([]byte("<value><int>7</int></value>"), &n)
+	assertEqual(t, nil, err, "decode pointer no error")
+	assertOk(t, n != nil && *n == 7, "decode allocates pointer")
+}
+
+func Test_PointerSlice(t *testing.T) {
+	people := []*person{{Name: "Kofi", Age: 10}, nil, {Name: "Ama", Age: 12}}
+
+	b := bytes.NewBufferString("")
+	err := withCodec(func(c *Codec) error {
+		return c.writeRPC(b, people)
+	})
+	assertEqual(t, nil, err, "encode pointer slice no error")
+	assertEqual(t, "<value><array><data>"+
+		"<value><struct><member><name>name</name><value><string>Kofi</string></value></member><member><name>age</name><value><int>10</int></value></member></struct></value>"+
+		"<value></value>"+
+		"<value><struct><member><name>name</name><value><string>Ama</string></value></member><member><name>age</name><value><int>12</int></value></member></struct></value>"+
+		"</data></array></value>", b.String(), "encode pointer slice")
+
+	var decoded []*person
+	err = withCodec(func(c *Codec) error {
+		return c.readRPC(b, &decoded)
+	})
+	assertEqual(t, nil, err, "decode pointer slice no error")
+	assertEqual(t, 3, len(decoded), "decode pointer slice length")
+	assertEqual(t, people[0], decoded[0], "decode pointer slice first element")
+	assertOk(t, decoded[1] == nil, "decode pointer slice nil element")
+	assertEqual(t, people[2], decoded[2], "decode pointer slice last element")
+}
+
+func Test_ByteSliceAsArray(t *testing.T) {
+	data := []byte{1, 2, 255}
+
+	b := bytes.NewBufferString("")
+	codec := NewCodec()
+	codec.writeRPC(b, data)
+	assertEqual(t, "<value><base64>AQL/</base64></value>", b.String(), "encode bytes as base64 by default")
+
+	var decoded []byte
+	err := codec.readRPC(b, &decoded)
+	assertEqual(t, nil, err, "decode base64 to bytes no error")
+	assertEqual(t, data, decoded, "decode base64 to bytes")
+
+	b.Reset()
+	codec = NewCodec(func(c *Codec) { c.ByteSliceAsArray(true) })
+	codec.writeRPC(b, data)
+	assertEqual(t, "<value><array><data>"+
+		"<value><int>1</int></value><value><int>2</int></value><value><int>255</int></value>"+
+		"</data></array></value>", b.String(), "encode bytes as array")
+
+	decoded = nil
+	err = codec.readRPC(b, &decoded)
+	assertEqual(t, nil, err, "decode array to bytes no error")
+	assertEqual(t, data, decoded, "decode array to bytes")
+
+	err = codec.readRPC(strings.NewReader("<value><array><data><value><int>256</int></value></data></array></value>"), &decoded)
+	assertNotEqual(t, nil, err, "decode array to bytes overflow")
+}
+
+func ExampleNewMethodCall() {
+	call, err := NewMethodCall("Arith.Add", struct{ A, B int }{2, 3})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var b bytes.Buffer
+	NewEncoder(&b, func(c *Codec) { c.OmitHeader(true) }).Encode(call)
+	fmt.Println(b.String())
+	// Output: <methodCall><methodName>Arith.Add</methodName><params><param><value><struct><member><name>A</name><value><int>2</int></value></member><member><name>B</name><value><int>3</int></value></member></struct></value></param></params></methodCall>
+}
+
+func Test_MethodCallResponse(t *testing.T) {
+	call, err := NewMethodCall("Arith.Max", 5, 9)
+	assertEqual(t, nil, err, "new method call no error")
+
+	b := bytes.NewBufferString("")
+	err = NewEncoder(b).Encode(call)
+	assertEqual(t, nil, err, "encode method call no error")
+
+	var decoded MethodCall
+	err = NewDecoder(b).Decode(&decoded)
+	assertEqual(t, nil, err, "decode method call no error")
+	assertEqual(t, "Arith.Max", decoded.Method(), "decode method call name")
+	params := decoded.Params()
+	assertEqual(t, 2, len(params), "decode method call params")
+	var n int
+	assertEqual(t, nil, params[1].Decode(&n), "decode method call param no error")
+	assertEqual(t, 9, n, "decode method call param")
+
+	// decoded params are forwarded unchanged
+	forward, err := NewMethodCall("Arith.Count", params[0], params[1])
+	assertEqual(t, nil, err, "forward method call no error")
+	assertEqual(t, call.Params(), forward.Params(), "forward method call params")
+
+	res, err := NewMethodResponse(InvalidParams.New("bad"))
+	assertEqual(t, nil, err, "new fault response no error")
+	b.Reset()
+	NewEncoder(b).Encode(res)
+
+	var decodedRes MethodResponse
+	err = NewDecoder(b).Decode(&decodedRes)
+	assertEqual(t, nil, err, "decode fault response no error")
+	fault, ok := decodedRes.Fault()
+	assertOk(t, ok, "decode fault response is fault")
+	assertEqual(t, InvalidParams.New("bad"), fault, "decode fault response")
+	assertEqual(t, 0, len(decodedRes.Params()), "fault response has no params")
+
+	res, _ = NewMethodResponse(42)
+	_, ok = res.Fault()
+	assertOk(t, !ok, "response is not fault")
+	assertEqual(t, nil, res.Params()[0].Decode(&n), "response param no error")
+	assertEqual(t, 42, n, "response param")
+
+	// the params are written with the settings of the encoder
+	type item struct {
+		Name string `json:"name"`
+		Data []byte `json:"data"`
+	}
+	encoder := func(w io.Writer) *Encoder {
+		return NewEncoder(w, func(c *Codec) {
+			c.OmitHeader(true)
+			c.SetTagKey("json")
+			c.ByteSliceAsArray(true)
+		})
+	}
+	call, _ = NewMethodCall("Items.Add", item{Name: "a", Data: []byte{1}})
+	b.Reset()
+	err = encoder(b).Encode(call)
+	assertEqual(t, nil, err, "encode method call with encoder settings no error")
+	assertEqual(t, "<methodCall><methodName>Items.Add</methodName><params><param><value><struct>"+
+		"<member><name>name</name><value><string>a</string></value></member>"+
+		"<member><name>data</name><value><array><data><value><int>1</int></value></data></array></value></member>"+
+		"</struct></value></param></params></methodCall>", b.String(), "method call uses encoder settings")
+
+	res, _ = NewMethodResponse(item{Name: "a"})
+	b.Reset()
+	err = encoder(b).Encode(res)
+	assertEqual(t, nil, err, "encode method response with encoder settings no error")
+	assertOk(t, strings.Contains(b.String(), "<name>name</name>"), "method response uses encoder settings. ", b.String())
+}
+
+func Test_ValueString(t *testing.T) {
+	input := "<value><struct>" +
+		"<member><name>name</name><value><string>Kofi</string></value></member>" +
+		"<member><name>age</name><value><int>10</int></value></member>" +
+		"<member><name>scores</name><value><array><data>" +
+		"<value><double>1.5</double></value><value><boolean>1</boolean></value><value><nil/></value>" +
+		"</data></array></value></member>" +
+		"<member><name>avatar</name><value><base64>aGVsbG8=</base64></value></member>" +
+		"<member><name>joined</name><value><dateTime.iso8601>20040101T12:30:10</dateTime.iso8601></value></member>" +
+		"<member><name>tags</name><value><array><data></data></array></value></member>" +
+		"</struct></value>"
+
+	var v Value
+	err := NewDecoder(strings.NewReader(input)).Decode(&v)
+	assertEqual(t, nil, err, "decode value no error")
+	assertEqual(t, `struct{name: "Kofi", age: 10, scores: array[1.5, true, nil], avatar: base64(aGVsbG8=), joined: dateTime(20040101T12:30:10), tags: array[]}`, v.String(), "dump value")
+}
+
+func Test_ValueInterface(t *testing.T) {
+	input := "<methodResponse><params><param><value><struct>" +
+		"<member><name>name</name><value><string>Kofi</string></value></member>" +
+		"<member><name>items</name><value><array><data>" +
+		"<value><i8>9000000000</i8></value>" +
+		"<value><struct><member><name>price</name><value><double>2.5</double></value></member></struct></value>" +
+		"</data></array></value></member>" +
+		"<member><name>avatar</name><value><base64>aGVsbG8=</base64></value></member>" +
+		"<member><name>joined</name><value><dateTime.iso8601>20040101T12:30:10</dateTime.iso8601></value></member>" +
+		"</struct></value></param></params></methodResponse>"
+	expected := map[string]interface{}{
+		"name": "Kofi",
+		"items": []interface{}{
+			int64(9000000000),
+			map[string]interface{}{"price": 2.5},
+		},
+		"avatar": []byte("hello"),
+		"joined": time.Date(2004, time.January, 1, 12, 30, 10, 0, time.UTC),
+	}
+
+	var res MethodResponse
+	err := NewDecoder(strings.NewReader(input)).Decode(&res)
+	assertEqual(t, nil, err, "decode response no error")
+	native := res.Params()[0].Interface()
+	assertEqual(t, expected, native, "convert value to native types")
+
+	m, ok := native.(map[string]interface{})
+	assertOk(t, ok, "struct as map")
+	_, ok = m["items"].([]interface{})
+	assertOk(t, ok, "array as slice")
+
+	var generic interface{}
+	err = withCodec(func(c *Codec) error {
+		return c.readResponse(strings.NewReader(input), &generic)
+	})
+	assertEqual(t, nil, err, "decode response into interface no error")
+	assertEqual(t, expected, generic, "decode response into interface")
+}
+
+// flushWriter is a writer which counts flushes and fails them when set
+type flushWriter struct {
+	bytes.Buffer
+	flushes int
+	err     error
+}
+
+func (w *flushWriter) Flush() error {
+	w.flushes++
+	return w.err
+}
+
+func Test_WriteFlushError(t *testing.T) {
+	codec := NewCodec()
+	failing := &flushWriter{err: fmt.Errorf("flush failed")}
+	err := codec.writeRPC(failing, 1)
+	assertEqual(t, failing.err, err, "write returns flush error")
+	assertEqual(t, 1, failing.flushes, "write flushes once")
+
+	ok := &flushWriter{}
+	err = codec.writeRPC(ok, 2)
+	assertEqual(t, nil, err, "reused codec has no stale flush error")
+	assertEqual(t, 1, failing.flushes, "previous writer is not flushed again")
+	assertEqual(t, 1, ok.flushes, "current writer flushed")
+	assertEqual(t, "<value><int>2</int></value>", ok.String(), "reused codec output")
+}
+
+func Test_PipeTransport(t *testing.T) {
+	requests, serverIn := io.Pipe()
+	responses, serverOut := io.Pipe()
+
+	// serve calls until the input is closed
+	done := make(chan error, 1)
+	go func() {
+		dec := NewDecoder(requests)
+		enc := NewEncoder(serverOut, func(c *Codec) { c.OmitHeader(true) })
+		for {
+			var method string
+			var args []int
+			err := dec.DecodeRequest(&method, &args)
+			if err == io.EOF {
+				done <- nil
+				return
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+			if method != "Arith.Sum" {
+				enc.EncodeResponse(MethodNotFound.New(""))
+				continue
+			}
+			sum := 0
+			for _, n := range args {
+				sum += n
+			}
+			enc.EncodeResponse(sum)
+		}
+	}()
+
+	enc := NewEncoder(serverIn, func(c *Codec) { c.OmitHeader(true) })
+	dec := NewDecoder(responses)
+
+	// each request is encoded in its own goroutine which ends before the next request
+	sent := make(chan error, 1)
+
+	var sum int
+	go func() { sent <- enc.EncodeRequest("Arith.Sum", 1, 2, 3) }()
+	err := dec.DecodeResponse(&sum)
+	assertEqual(t, nil, err, "pipe call no error")
+	assertEqual(t, 6, sum, "pipe call response")
+	assertEqual(t, nil, <-sent, "pipe call sent")
+
+	go func() { sent <- enc.EncodeRequest("Arith.Product", 1, 2) }()
+	err = dec.DecodeResponse(&sum)
+	assertOk(t, errors.Is(err, MethodNotFound), "pipe call fault")
+	assertEqual(t, nil, <-sent, "pipe fault call sent")
+
+	serverIn.Close()
+	assertEqual(t, nil, <-done, "pipe server stops at end of input")
+}
+
+func Test_ReadDateTimeOffset(t *testing.T) {
+	for input, offset := range map[string]int{
+		"20040101T12:30:10-07:00":      -7 * 3600,
+		"20040101T12:30:10.5+05:30":    5*3600 + 30*60,
+		"2004-01-01T12:30:10-07:00":    -7 * 3600,
+		"2004-01-01T12:30:10.25+01:00": 3600,
+		"2004-01-01T12:30:10Z":         0,
+		"20040101T12:30:10Z":           0,
+	} {
+		var v time.Time
+		err := Unmarshal([]byte("<value><dateTime.iso8601>"+input+"</dateTime.iso8601></value>"), &v)
+		assertEqual(t, nil, err, "decode dateTime with offset no error ", input)
+		_, actual := v.Zone()
+		assertEqual(t, offset, actual, "decode dateTime preserves offset ", input)
+		assertEqual(t, 12, v.Hour(), "decode dateTime keeps wall clock ", input)
+	}
+}
+
+func Test_DefaultLocation(t *testing.T) {
+	loc := time.FixedZone("EST", -5*3600)
+	codec := NewCodec(func(c *Codec) { c.SetDefaultLocation(loc) })
+
+	var v time.Time
+	err := codec.readRPC(strings.NewReader("<value><dateTime.iso8601>20040101T12:30:10</dateTime.iso8601></value>"), &v)
+	assertEqual(t, nil, err, "decode dateTime in default location no error")
+	assertEqual(t, time.Date(2004, time.January, 1, 12, 30, 10, 0, loc), v, "decode dateTime in default location")
+
+	err = codec.readRPC(strings.NewReader("<value><dateTime.iso8601>2004-01-01T12:30:10+01:00</dateTime.iso8601></value>"), &v)
+	assertEqual(t, nil, err, "decode dateTime with offset no error")
+	_, offset := v.Zone()
+	assertEqual(t, 3600, offset, "decode dateTime with offset ignores default location")
+
+	err = NewCodec().readRPC(strings.NewReader("<value><dateTime.iso8601>20040101T12:30:10</dateTime.iso8601></value>"), &v)
+	assertEqual(t, nil, err, "decode dateTime in UTC no error")
+	assertEqual(t, time.UTC, v.Location(), "decode dateTime in UTC by default")
+}
+
+func Test_EncodeTimesIn(t *testing.T) {
+	local := time.Date(2004, time.January, 1, 12, 30, 10, 0, time.FixedZone("EST", -5*3600))
+
+	b := bytes.NewBufferString("")
+	NewCodec().writeRPC(b, local)
+	assertEqual(t, "<value><dateTime.iso8601>20040101T12:30:10</dateTime.iso8601></value>", b.String(), "encode time in own location")
+
+	b.Reset()
+	codec := NewCodec(func(c *Codec) { c.EncodeTimesIn(time.UTC) })
+	codec.writeRPC(b, local)
+	assertEqual(t, "<value><dateTime.iso8601>20040101T17:30:10</dateTime.iso8601></value>", b.String(), "encode time in UTC")
+
+	b.Reset()
+	codec.writeRPC(b, local.UTC())
+	assertEqual(t, "<value><dateTime.iso8601>20040101T17:30:10</dateTime.iso8601></value>", b.String(), "encode same instant identically")
+}
+
+// uuid is an identifier encoded as text
+type uuid [4]byte
+
+func (u uuid) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%x", u[:])), nil
+}
+
+func (u *uuid) UnmarshalText(text []byte) error {
+	if len(text) != 8 {
+		return fmt.Errorf("invalid uuid '%s'", text)
+	}
+	_, err := hex.Decode(u[:], text)
+	return err
+}
+
+func Test_TextMarshaler(t *testing.T) {
+	type record struct {
+		ID    uuid      `rpc:"id"`
+		Owner *uuid     `rpc:"owner"`
+		IP    net.IP    `rpc:"ip"`
+		When  time.Time `rpc:"when"`
+	}
+	owner := uuid{0xca, 0xfe, 0xba, 0xbe}
+	rec := record{
+		ID:    uuid{0xde, 0xad, 0xbe, 0xef},
+		Owner: &owner,
+		IP:    net.ParseIP("10.0.0.1"),
+		When:  time.Date(2004, time.January, 1, 12, 30, 10, 0, time.UTC),
+	}
+
+	b := bytes.NewBufferString("")
+	err := withCodec(func(c *Codec) error {
+		return c.writeRPC(b, rec)
+	})
+	assertEqual(t, nil, err, "encode text marshalers no error")
+	assertEqual(t, "<value><struct>"+
+		"<member><name>id</name><value><string>deadbeef</string></value></member>"+
+		"<member><name>owner</name><value><string>cafebabe</string></value></member>"+
+		"<member><name>ip</name><value><string>10.0.0.1</string></value></member>"+
+		"<member><name>when</name><value><dateTime.iso8601>20040101T12:30:10</dateTime.iso8601></value></member>"+
+		"</struct></value>", b.String(), "encode text marshalers as strings")
+
+	var decoded record
+	err = withCodec(func(c *Codec) error {
+		return c.readRPC(b, &decoded)
+	})
+	assertEqual(t, nil, err, "decode text unmarshalers no error")
+	assertEqual(t, rec, decoded, "decode text unmarshalers")
+
+	var id uuid
+	err = Unmarshal([]byte("<value><string>bad</string></value>"), &id)
+	assertNotEqual(t, nil, err, "decode text unmarshaler error")
+}
+
+func Test_BigInt(t *testing.T) {
+	large, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	type account struct {
+		ID      *big.Int `rpc:"id"`
+		Balance big.Int  `rpc:"balance"`
+	}
+	a := account{ID: large}
+	a.Balance.SetInt64(-9000000000)
+
+	b := bytes.NewBufferString("")
+	err := withCodec(func(c *Codec) error {
+		return c.writeRPC(b, &a)
+	})
+	assertEqual(t, nil, err, "encode big integers no error")
+	assertEqual(t, "<value><struct>"+
+		"<member><name>id</name><value><string>123456789012345678901234567890</string></value></member>"+
+		"<member><name>balance</name><value><i8>-9000000000</i8></value></member>"+
+		"</struct></value>", b.String(), "encode big integers")
+
+	var decoded account
+	err = withCodec(func(c *Codec) error {
+		return c.readRPC(b, &decoded)
+	})
+	assertEqual(t, nil, err, "decode big integers no error")
+	assertEqual(t, 0, large.Cmp(decoded.ID), "decode big integer from string")
+	assertEqual(t, int64(-9000000000), decoded.Balance.Int64(), "decode big integer from i8")
+
+	var n big.Int
+	err = Unmarshal([]byte("<value><string>12a</string></value>"), &n)
+	assertNotEqual(t, nil, err, "decode invalid big integer")
+}
+
+func Test_UnsignedSource(t *testing.T) {
+	// values made from unsigned Go integers keep their unsigned type until written
+	call, err := NewMethodCall("Stats.Add", uint64(42), uint8(7))
+	assertEqual(t, nil, err, "new method call with unsigned params no error")
+	params := call.Params()
+
+	var n big.Int
+	assertEqual(t, nil, params[0].Decode(&n), "decode unsigned to big integer no error")
+	assertEqual(t, int64(42), n.Int64(), "decode unsigned to big integer")
+
+	var i int
+	assertEqual(t, nil, params[1].Decode(&i), "decode unsigned to int no error")
+	assertEqual(t, 7, i, "decode unsigned to int")
+
+	var s string
+	weak := &Value{rpc: params[0].rpc, cfg: &codecConfig{weakTyping: true}}
+	assertEqual(t, nil, weak.Decode(&s), "decode unsigned to string no error")
+	assertEqual(t, "42", s, "decode unsigned to string")
+}
+
+func Test_StrictMode(t *testing.T) {
+	strict := NewCodec()
+	strict.StrictMode(true)
+	lenient := NewCodec()
+
+	for _, input := range []string{
+		"<value><i8>9000000000</i8></value>",
+		"<value><nil/></value>",
+		"<value><array><data><value><nil/></value></data></array></value>",
+	} {
+		var v interface{}
+		err := lenient.readRPC(strings.NewReader(input), &v)
+		assertEqual(t, nil, err, "lenient mode accepts "+input)
+
+		err = strict.readRPC(strings.NewReader(input), &v)
+		fault, ok := err.(Fault)
+		assertOk(t, ok, "strict mode fault for "+input)
+		assertEqual(t, int(InvalidRequest), fault.Code, "strict mode rejects "+input)
+	}
+
+	var n int
+	err := strict.readRPC(strings.NewReader("<value><int>10</int></value>"), &n)
+	assertEqual(t, nil, err, "strict mode accepts int no error")
+	assertEqual(t, 10, n, "strict mode accepts int")
+
+	err = strict.readRPC(strings.NewReader("<value><i4>12</i4></value>"), &n)
+	assertEqual(t, nil, err, "strict mode accepts i4 no error")
+	assertEqual(t, 12, n, "strict mode accepts i4")
+}
+
+func Test_SelfClosingPrimitives(t *testing.T) {
+	fixtures := map[string]interface{}{
+		"string":           "",
+		"boolean":          false,
+		"int":              0,
+		"i4":               0,
+		"i8":               0,
+		"double":           0.0,
+		"base64":           []byte{},
+		"dateTime.iso8601": time.Time{},
+		"nil":              nil,
+	}
+
+	withCodec(func(c *Codec) error {
+		for tag, expected := range fixtures {
+			// both spellings of an empty element are the zero value
+			for _, input := range []string{"<" + tag + "/>", "<" + tag + "></" + tag + ">"} {
+				var v interface{}
+				err := c.readRPC(strings.NewReader("<value>"+input+"</value>"), &v)
+				assertEqual(t, nil, err, "decode empty element no error ", input)
+				assertEqual(t, expected, v, "decode empty element ", input)
+			}
+		}
+
+		var args struct {
+			Name  string `rpc:"name"`
+			Count int    `rpc:"count"`
+		}
+		input := "<value><struct><member><name>count</name><value><int/></value></member>" +
+			"<member><name>name</name><value><string>Kofi</string></value></member></struct></value>"
+		err := c.readRPC(strings.NewReader(input), &args)
+		assertEqual(t, nil, err, "decode struct with self-closing member no error")
+		assertEqual(t, "Kofi", args.Name, "decode member after self-closing member")
+
+		n := 1
+		err = c.readRPC(strings.NewReader("<value><int> </int></value>"), &n)
+		assertNotEqual(t, nil, err, "whitespace int content is not empty")
+		return nil
+	})
+}
+
+func Test_EmptyNumericAsZero(t *testing.T) {
+	fixtures := map[string]interface{}{
+		"<int> </int>":       0,
+		"<i4>\n</i4>":        0,
+		"<i8>\t</i8>":        0,
+		"<double> </double>": 0.0,
+	}
+
+	lenient := NewCodec()
+	lenient.EmptyNumericAsZero(true)
+	for input, expected := range fixtures {
+		var v interface{}
+		err := NewCodec().readRPC(strings.NewReader("<value>"+input+"</value>"), &v)
+		fault, ok := err.(Fault)
+		assertOk(t, ok, "empty numeric fault ", input)
+		assertEqual(t, int(InvalidRequest), fault.Code, "empty numeric rejected by default ", input)
+
+		err = lenient.readRPC(strings.NewReader("<value>"+input+"</value>"), &v)
+		assertEqual(t, nil, err, "empty numeric as zero no error ", input)
+		assertEqual(t, expected, v, "empty numeric as zero ", input)
+	}
+
+	var n int
+	err := lenient.readRPC(strings.NewReader("<value><int>x</int></value>"), &n)
+	assertNotEqual(t, nil, err, "invalid numeric rejected with empty numeric as zero")
+}
+
+func Test_DecodeGoArray(t *testing.T) {
+	input := "<value><array><data><value><int>1</int></value><value><int>2</int></value><value><int>3</int></value></data></array></value>"
+
+	var a [3]int
+	err := Unmarshal([]byte(input), &a)
+	assertEqual(t, nil, err, "decode Go array no error")
+	assertEqual(t, [3]int{1, 2, 3}, a, "decode Go array")
+
+	var point struct {
+		Coords [3]int `rpc:"coords"`
+	}
+	err = Unmarshal([]byte("<value><struct><member><name>coords</name>"+input+"</member></struct></value>"), &point)
+	assertEqual(t, nil, err, "decode Go array field no error")
+	assertEqual(t, [3]int{1, 2, 3}, point.Coords, "decode Go array field")
+
+	var short [2]int
+	err = Unmarshal([]byte(input), &short)
+	assertNotEqual(t, nil, err, "decode Go array with fewer elements")
+
+	var long [4]int
+	err = Unmarshal([]byte(input), &long)
+	assertNotEqual(t, nil, err, "decode Go array with more elements")
+}
+
+func Test_ArrayAsStruct(t *testing.T) {
+	input := "<value><array><data><value><int>1</int></value><value><string>Kofi</string></value></data></array></value>"
+
+	type user struct {
+		ID   int
+		Name string
+	}
+
+	var u user
+	err := NewCodec().readRPC(strings.NewReader(input), &u)
+	assertNotEqual(t, nil, err, "decode array into struct disabled by default")
+
+	codec := NewCodec()
+	codec.ArrayAsStruct(true)
+	err = codec.readRPC(strings.NewReader(input), &u)
+	assertEqual(t, nil, err, "decode array into struct no error")
+	assertEqual(t, user{ID: 1, Name: "Kofi"}, u, "decode array into struct")
+
+	type base struct {
+		ID int
+	}
+	type account struct {
+		base
+		Ignored string `rpc:"-"`
+		Name    string
+		Age     int
+	}
+	var a account
+	err = codec.readRPC(strings.NewReader(input), &a)
+	assertEqual(t, nil, err, "decode array into struct with embedded struct no error")
+	assertEqual(t, account{base: base{ID: 1}, Name: "Kofi"}, a, "decode array into struct with embedded struct")
+
+	var short struct{ ID int }
+	err = codec.readRPC(strings.NewReader(input), &short)
+	assertNotEqual(t, nil, err, "decode array with extra elements into struct")
+}
+
+func Test_WeakTyping(t *testing.T) {
+	type reading struct {
+		ID     int     `rpc:"id"`
+		Count  uint8   `rpc:"count"`
+		Value  float32 `rpc:"value"`
+		Active bool    `rpc:"active"`
+		Serial string  `rpc:"serial"`
+		Ratio  string  `rpc:"ratio"`
+	}
+	input := "<value><struct>" +
+		"<member><name>id</name><value><string>42</string></value></member>" +
+		"<member><name>count</name><value><string> 7 </string></value></member>" +
+		"<member><name>value</name><value><string>1.5</string></value></member>" +
+		"<member><name>active</name><value><string>true</string></value></member>" +
+		"<member><name>serial</name><value><int>1001</int></value></member>" +
+		"<member><name>ratio</name><value><double>0.25</double></value></member>" +
+		"</struct></value>"
+
+	var r reading
+	err := NewCodec().readRPC(strings.NewReader(input), &r)
+	assertNotEqual(t, nil, err, "weak typing disabled by default")
+
+	codec := NewCodec()
+	codec.WeakTyping(true)
+	r = reading{}
+	err = codec.readRPC(strings.NewReader(input), &r)
+	assertEqual(t, nil, err, "weak typing no error")
+	assertEqual(t, reading{ID: 42, Count: 7, Value: 1.5, Active: true, Serial: "1001", Ratio: "0.25"}, r, "weak typing conversions")
+
+	var n int
+	err = codec.readRPC(strings.NewReader("<value><string>forty</string></value>"), &n)
+	assertNotEqual(t, nil, err, "weak typing rejects non-numeric string")
+
+	var b uint8
+	err = codec.readRPC(strings.NewReader("<value><string>300</string></value>"), &b)
+	assertNotEqual(t, nil, err, "weak typing rejects overflow")
+
+	var s string
+	err = codec.readRPC(strings.NewReader("<value><string>42</string></value>"), &s)
+	assertEqual(t, nil, err, "weak typing keeps strings no error")
+	assertEqual(t, "42", s, "weak typing keeps strings")
+}
+
+func Test_PresentFields(t *testing.T) {
+	type address struct {
+		City    string `rpc:"city"`
+		Country string `rpc:"country"`
+	}
+	type user struct {
+		Name    string  `rpc:"name"`
+		Age     int     `rpc:"age"`
+		Address address `rpc:"address"`
+	}
+	input := "<value><struct>" +
+		"<member><name>name</name><value><string>Kofi</string></value></member>" +
+		"<member><name>address</name><value><struct>" +
+		"<member><name>city</name><value><string>Accra</string></value></member>" +
+		"</struct></value></member>" +
+		"</struct></value>" +
+		"<value><int>10</int></value>"
+
+	d := NewDecoder(strings.NewReader(input), func(c *Codec) { c.TrackPresentFields(true) })
+	var u user
+	err := d.Decode(&u)
+	assertEqual(t, nil, err, "decode partial struct no error")
+	assertEqual(t, map[string]bool{"name": true, "address": true, "address.city": true}, d.PresentFields(), "present fields")
+
+	var n int
+	err = d.Decode(&n)
+	assertEqual(t, nil, err, "decode next value no error")
+	assertEqual(t, map[string]bool{}, d.PresentFields(), "no present fields for non-struct value")
+
+	d = NewDecoder(strings.NewReader(input))
+	err = d.Decode(&u)
+	assertEqual(t, nil, err, "decode without tracking no error")
+	assertEqual(t, 0, len(d.PresentFields()), "present fields not tracked by default")
+}
+
+func Test_DefaultTagValues(t *testing.T) {
+	type options struct {
+		Host    string  `rpc:"host,default=localhost"`
+		Port    int     `rpc:"port,default=8080"`
+		Ratio   float64 `rpc:"ratio,default=0.5"`
+		Verbose bool    `rpc:"verbose,default=true"`
+		Retries *uint   `rpc:"retries,default=3"`
+		Name    string  `rpc:"name"`
+	}
+	input := "<value><struct>" +
+		"<member><name>port</name><value><int>9000</int></value></member>" +
+		"<member><name>name</name><value><string>api</string></value></member>" +
+		"</struct></value>"
+
+	var o options
+	err := Unmarshal([]byte(input), &o)
+	assertEqual(t, nil, err, "decode with defaults no error")
+	assertEqual(t, "localhost", o.Host, "absent string member default")
+	assertEqual(t, 9000, o.Port, "present member ignores default")
+	assertEqual(t, 0.5, o.Ratio, "absent double member default")
+	assertEqual(t, true, o.Verbose, "absent boolean member default")
+	assertEqual(t, uint(3), *o.Retries, "absent pointer member default")
+	assertEqual(t, "api", o.Name, "member without default")
+
+	var invalid struct {
+		Port    int    `rpc:"port"`
+		Timeout int    `rpc:"timeout,default=soon"`
+		Name    string `rpc:"name"`
+	}
+	err = Unmarshal([]byte(input), &invalid)
+	assertNotEqual(t, nil, err, "invalid default value")
+
+	// an empty struct has every member absent
+	o = options{}
+	err = Unmarshal([]byte("<value><struct></struct></value>"), &o)
+	assertEqual(t, nil, err, "decode empty struct with defaults no error")
+	assertEqual(t, "localhost", o.Host, "empty struct string default")
+	assertEqual(t, 8080, o.Port, "empty struct int default")
+	assertEqual(t, uint(3), *o.Retries, "empty struct pointer default")
+
+	var empty *options
+	err = Unmarshal([]byte("<value><struct></struct></value>"), &empty)
+	assertEqual(t, nil, err, "decode empty struct to pointer no error")
+	assertEqual(t, 8080, empty.Port, "empty struct pointer target default")
+
+	// present members are written to the fields set by the caller without reallocating pointers
+	retries := uint(1)
+	o = options{Retries: &retries}
+	err = Unmarshal([]byte("<value><struct><member><name>retries</name><value><int>5</int></value></member></struct></value>"), &o)
+	assertEqual(t, nil, err, "decode present pointer member no error")
+	assertOk(t, o.Retries == &retries, "present pointer member keeps the caller pointer")
+	assertEqual(t, uint(5), retries, "present pointer member value")
+	assertEqual(t, "localhost", o.Host, "absent member default with present members")
+
+	o = options{Retries: &retries}
+	err = Unmarshal([]byte("<value><struct></struct></value>"), &o)
+	assertEqual(t, nil, err, "decode absent pointer member no error")
+	assertOk(t, o.Retries == &retries, "absent pointer member default keeps the caller pointer")
+	assertEqual(t, uint(3), retries, "absent pointer member default value")
+
+	// options are separated by commas so a default value cannot contain one
+	named := "<value><struct><member><name>name</name><value><string>api</string></value></member></struct></value>"
+	var comma struct {
+		Host string `rpc:"host,default=a,b"`
+		Name string `rpc:"name"`
+	}
+	err = Unmarshal([]byte(named), &comma)
+	assertOk(t, errors.Is(err, InternalError), "default value with a comma is rejected")
+	assertOk(t, strings.Contains(err.Error(), "'a,b'"), "default value with a comma is reported. ", err)
+
+	var omit struct {
+		Host string `rpc:"host,default=localhost,omitempty"`
+		Name string `rpc:"name"`
+	}
+	err = Unmarshal([]byte(named), &omit)
+	assertEqual(t, nil, err, "default followed by an option no error")
+	assertEqual(t, "localhost", omit.Host, "default followed by an option")
+}
+
+func Test_CodecPoolSnapshot(t *testing.T) {
+	codec := NewCodec()
+	codec.AddDateTimeFormat("2006-01-02")
+	pool := newCodecPool(codec)
+
+	// settings changed after the pool is created do not reach pooled codecs
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			withPooledCodec(pool, func(c *Codec) error { return nil })
+		}()
+	}
+	codec.StrictMode(true)
+	codec.SetMaxDepth(3)
+	codec.AddDateTimeFormat("2006")
+	wg.Wait()
+
+	c := pool.Get().(*Codec)
+	assertOk(t, !c.cfg.strict, "pooled codec keeps strict mode of snapshot")
+	assertEqual(t, 0, c.cfg.maxDepth, "pooled codec keeps max depth of snapshot")
+	assertEqual(t, []string{"2006-01-02"}, c.cfg.dateTimeFormats, "pooled codec keeps formats of snapshot")
+
+	// clones do not share formats with the original
+	original := NewCodec()
+	original.AddDateTimeFormat("a")
+	original.AddDateTimeFormat("b")
+	original.AddDateTimeFormat("c")
+	clone := original.clone()
+	clone.AddDateTimeFormat("clone")
+	original.AddDateTimeFormat("original")
+	assertEqual(t, []string{"a", "b", "c", "clone"}, clone.cfg.dateTimeFormats, "clone formats independent")
+}
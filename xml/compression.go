@@ -8,16 +8,25 @@ import (
 	"net/http"
 	"regexp"
 	"sync"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 var (
-	contentEncodingRe = regexp.MustCompile(`(gzip|deflate)`)
+	contentEncodingRe = regexp.MustCompile(`(gzip|deflate|zstd)`)
 	gzipWriterPool    = &sync.Pool{
 		New: func() interface{} { return gzip.NewWriter(ioutil.Discard) },
 	}
 	flateWriterPool = &sync.Pool{
 		New: func() interface{} { w, _ := flate.NewWriter(ioutil.Discard, flate.DefaultCompression); return w },
 	}
+	// zstd encoders and decoders are used by one request at a time so they run without extra goroutines
+	zstdWriterPool = &sync.Pool{
+		New: func() interface{} { w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1)); return w },
+	}
+	zstdReaderPool = &sync.Pool{
+		New: func() interface{} { r, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1)); return r },
+	}
 )
 
 type writeResetter interface {
@@ -37,42 +46,90 @@ func (w *compressWriter) Close() error {
 		gzipWriterPool.Put(w.writeResetter)
 	case "deflate":
 		flateWriterPool.Put(w.writeResetter)
+	case "zstd":
+		zstdWriterPool.Put(w.writeResetter)
 	}
 	return err
 }
 
+// zstdReader returns the decoder to the pool when closed
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (r *zstdReader) Close() error {
+	// release the input. the decoder stays usable unlike with Decoder.Close
+	r.Decoder.Reset(nil)
+	zstdReaderPool.Put(r.Decoder)
+	return nil
+}
+
 func newCompressor(w http.ResponseWriter, header http.Header) io.Writer {
 	encoding := header.Get("Accept-Encoding")
 	if encoding != "" {
 		encoding = contentEncodingRe.FindString(encoding)
 	}
+	if zw := newCompressWriter(w, encoding); zw != nil {
+		w.Header().Set("Content-Encoding", encoding)
+		return zw
+	}
+	return w
+}
+
+// newCompressWriter returns a pooled writer compressing to w with the encoding, or nil if not supported
+func newCompressWriter(w io.Writer, encoding string) *compressWriter {
+	var zw *compressWriter
 	switch encoding {
 	case "gzip":
-		w.Header().Set("Content-Encoding", "gzip")
-		zw := &compressWriter{writeResetter: gzipWriterPool.Get().(*gzip.Writer), encoding: encoding}
-		zw.Reset(w)
-		return zw
+		zw = &compressWriter{writeResetter: gzipWriterPool.Get().(*gzip.Writer), encoding: encoding}
 	case "deflate":
-		w.Header().Set("Content-Encoding", "deflate")
-		zw := &compressWriter{writeResetter: flateWriterPool.Get().(*flate.Writer), encoding: encoding}
-		zw.Reset(w)
-		return zw
+		zw = &compressWriter{writeResetter: flateWriterPool.Get().(*flate.Writer), encoding: encoding}
+	case "zstd":
+		zw = &compressWriter{writeResetter: zstdWriterPool.Get().(*zstd.Encoder), encoding: encoding}
 	default:
-		return w
+		return nil
 	}
+	zw.Reset(w)
+	return zw
+}
+
+// decompressReader closes the body along with the reader decompressing it
+type decompressReader struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (r *decompressReader) Close() error {
+	err := r.ReadCloser.Close()
+	if cerr := r.body.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-func newDecompressor(resp *http.Response) io.ReadCloser {
-	encoding := resp.Header.Get("Content-Encoding")
+// newDecompressor returns a reader decompressing the body according to the Content-Encoding header.
+// Closing the reader closes the body. A body without a valid header for the encoding is a MalformedInput fault
+func newDecompressor(body io.ReadCloser, header http.Header) (io.ReadCloser, error) {
+	encoding := header.Get("Content-Encoding")
 	if encoding != "" {
 		encoding = contentEncodingRe.FindString(encoding)
 	}
 	switch encoding {
 	case "gzip":
-		zr, _ := gzip.NewReader(resp.Body)
-		return zr
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, MalformedInput.New("invalid gzip body. %s", err)
+		}
+		return &decompressReader{ReadCloser: zr, body: body}, nil
 	case "deflate":
-		return flate.NewReader(resp.Body)
+		return &decompressReader{ReadCloser: flate.NewReader(body), body: body}, nil
+	case "zstd":
+		zr := zstdReaderPool.Get().(*zstd.Decoder)
+		if err := zr.Reset(body); err != nil {
+			zstdReaderPool.Put(zr)
+			return nil, MalformedInput.New("invalid zstd body. %s", err)
+		}
+		return &decompressReader{ReadCloser: &zstdReader{zr}, body: body}, nil
 	}
-	return resp.Body
+	return body, nil
 }
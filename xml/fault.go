@@ -3,12 +3,17 @@ package xml
 import (
 	"fmt"
 	"strconv"
+	"sync"
 )
 
 // Fault represents an XML-RPC fault.
+// Data holds an optional "data" member with details of the fault which is not part of the spec.
+// Faults with a map or slice in Data panic when compared with ==. Match them with errors.Is
+// against a fault code, a Fault without Data or a *Fault, which compares only the code and message.
 type Fault struct {
-	Code    int    `rpc:"faultCode"`
-	Message string `rpc:"faultString"`
+	Code    int         `rpc:"faultCode"`
+	Message string      `rpc:"faultString"`
+	Data    interface{} `rpc:"data,omitempty"`
 }
 
 // Error returns a formatted error string
@@ -16,23 +21,52 @@ func (f Fault) Error() string {
 	return fmt.Sprintf("%d: %s", f.Code, f.Message)
 }
 
-type faultCode int
+// Is reports whether the target is a Fault or fault code with the same code.
+// A target Fault with a message also matches the message. Data is never compared.
+// This allows matching with errors.Is(err, Fault{Code: -32602}) or errors.Is(err, InvalidParams).
+// A target with Data must be a *Fault since errors.Is compares Fault values with == first.
+func (f Fault) Is(target error) bool {
+	switch t := target.(type) {
+	case Fault:
+		return f.matches(t)
+	case *Fault:
+		return t != nil && f.matches(*t)
+	case FaultCode:
+		return f.Code == int(t)
+	}
+	return false
+}
+
+// matches reports whether the fault has the code of the target and its message when set
+func (f Fault) matches(target Fault) bool {
+	return f.Code == target.Code && (target.Message == "" || f.Message == target.Message)
+}
+
+// FaultCode is the code of a kind of fault. It creates faults with New and matches them with errors.Is.
+type FaultCode int
 
 // Codes: http://xmlrpc-epi.sourceforge.net/specs/rfc.fault_codes.php
 const (
 	// parse error
-	MalformedInput      faultCode = -32700
-	UnsupportedEncoding faultCode = -32701
-	InvalidCharacter    faultCode = -32702
+	MalformedInput      FaultCode = -32700
+	UnsupportedEncoding FaultCode = -32701
+	InvalidCharacter    FaultCode = -32702
 	// server error
-	InvalidRequest faultCode = -32600
-	MethodNotFound faultCode = -32601
-	InvalidParams  faultCode = -32602
-	InternalError  faultCode = -32603
+	InvalidRequest FaultCode = -32600
+	MethodNotFound FaultCode = -32601
+	InvalidParams  FaultCode = -32602
+	InternalError  FaultCode = -32603
+)
+
+const (
+	// range of fault codes reserved for XML-RPC implementations
+	minReservedCode = -32768
+	maxReservedCode = -32000
 )
 
 var (
-	faultMessages = map[faultCode]string{
+	faultMtx      sync.RWMutex
+	faultMessages = map[FaultCode]string{
 		MalformedInput:      "malformed input",
 		UnsupportedEncoding: "unsupported encoding",
 		InvalidCharacter:    "invalid character for encoding",
@@ -43,15 +77,33 @@ var (
 	}
 )
 
-func (f faultCode) String() string {
+// RegisterFaultCode register an application fault code with its default message.
+// The returned code creates faults with the default message when none is given.
+// Codes in the range -32768 to -32000 are reserved and cannot be registered.
+func RegisterFaultCode(code int, message string) (FaultCode, error) {
+	if code >= minReservedCode && code <= maxReservedCode {
+		return 0, fmt.Errorf("fault code %d is reserved", code)
+	}
+	faultMtx.Lock()
+	faultMessages[FaultCode(code)] = message
+	faultMtx.Unlock()
+	return FaultCode(code), nil
+}
+
+// String returns the default message of the fault code
+func (f FaultCode) String() string {
+	faultMtx.RLock()
+	defer faultMtx.RUnlock()
 	return faultMessages[f]
 }
 
-func (f faultCode) Error() string {
+// Error returns a formatted error string
+func (f FaultCode) Error() string {
 	return strconv.Itoa(int(f)) + ": " + f.String()
 }
 
-func (f faultCode) New(format string, v ...interface{}) Fault {
+// New returns a fault with the code and formatted message, or the default message when empty
+func (f FaultCode) New(format string, v ...interface{}) Fault {
 	s := fmt.Sprintf(format, v...)
 	if len(s) == 0 {
 		s = f.String()
@@ -0,0 +1,211 @@
+package xml
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var (
+	// precomputed types of service method arguments
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfRequest = reflect.TypeOf((*http.Request)(nil))
+)
+
+// Handler is an http.Handler serving XML-RPC calls to registered services without gorilla/rpc.
+//
+// Service methods have the same form as for gorilla/rpc:
+//
+//	func (t *T) Method(r *http.Request, args *Args, reply *Reply) error
+//
+// Request-scoped values, deadlines and cancellation are available from r.Context().
+// A panic in a method or middleware is logged and returned to the client as an InternalError fault.
+type Handler struct {
+	services   map[string]*service
+	middleware []func(MethodHandler) MethodHandler
+	debug      bool
+	logger     *log.Logger
+	mapError   func(error) (Fault, bool)
+	codecs     *sync.Pool
+	mtx        sync.RWMutex
+}
+
+// MethodHandler handles a call to the method with the decoded arguments and returns the reply.
+// Returning a Fault as the error sends it to the client.
+type MethodHandler func(r *http.Request, method string, args interface{}) (reply interface{}, err error)
+
+// service is a receiver with its exported methods
+type service struct {
+	receiver reflect.Value
+	methods  map[string]*serviceMethod
+}
+
+// serviceMethod holds the method and the types of its arguments
+type serviceMethod struct {
+	method    reflect.Method
+	argsType  reflect.Type
+	replyType reflect.Type
+}
+
+// NewHandler returns a new standalone XML-RPC handler configured with the given options.
+func NewHandler(options ...func(*Handler)) *Handler {
+	h := &Handler{
+		services: make(map[string]*service),
+		codecs:   codecPool,
+	}
+	for _, opt := range options {
+		opt(h)
+	}
+	return h
+}
+
+// WithDebugFaults configure the handler to include the panic value and stack in the fault returned
+// for a panic in a method, and the text of other errors which are not faults.
+// Faults have a generic message by default to avoid exposing internals.
+func WithDebugFaults(enable bool) func(*Handler) {
+	return func(h *Handler) {
+		h.debug = enable
+	}
+}
+
+// WithLogger configure the logger of panics in methods and errors reported to the client as an InternalError.
+// They are logged with the standard logger by default.
+func WithLogger(logger *log.Logger) func(*Handler) {
+	return func(h *Handler) {
+		h.logger = logger
+	}
+}
+
+// SetCodec configure the codec settings used to read requests and write responses.
+// The settings are copied so later changes to the codec do not affect the handler.
+func (h *Handler) SetCodec(codec *Codec) {
+	h.codecs = newCodecPool(codec)
+}
+
+// SetErrorMapper configure a function translating errors returned by service methods to faults.
+// It is consulted for errors which are not faults before they are reported as an InternalError.
+func (h *Handler) SetErrorMapper(mapper func(error) (Fault, bool)) {
+	h.mapError = mapper
+}
+
+// Use adds middleware run around each call after the arguments are decoded.
+// Middleware run in the order added and may return without calling next to reject a call.
+func (h *Handler) Use(middleware ...func(next MethodHandler) MethodHandler) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.middleware = append(h.middleware, middleware...)
+}
+
+// Register adds the exported methods of the receiver to the handler as "name.Method".
+// The name of the receiver type is used when name is empty.
+func (h *Handler) Register(receiver interface{}, name string) error {
+	s := &service{
+		receiver: reflect.ValueOf(receiver),
+		methods:  make(map[string]*serviceMethod),
+	}
+	if name == "" {
+		name = reflect.Indirect(s.receiver).Type().Name()
+	}
+	if name == "" {
+		return fmt.Errorf("rpc: no service name for type %s", s.receiver.Type())
+	}
+
+	refType := s.receiver.Type()
+	for i := 0; i < refType.NumMethod(); i++ {
+		method := refType.Method(i)
+		mtype := method.Type
+		// skip unexported methods and methods of the wrong form
+		if method.PkgPath != "" || mtype.NumIn() != 4 || mtype.NumOut() != 1 {
+			continue
+		}
+		if mtype.In(1) != typeOfRequest || mtype.Out(0) != typeOfError {
+			continue
+		}
+		args, reply := mtype.In(2), mtype.In(3)
+		if args.Kind() != reflect.Ptr || reply.Kind() != reflect.Ptr {
+			continue
+		}
+		s.methods[method.Name] = &serviceMethod{
+			method:    method,
+			argsType:  args.Elem(),
+			replyType: reply.Elem(),
+		}
+	}
+	if len(s.methods) == 0 {
+		return fmt.Errorf("rpc: %s has no exported methods of suitable type", name)
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if _, ok := h.services[name]; ok {
+		return fmt.Errorf("rpc: service already defined: %s", name)
+	}
+	h.services[name] = s
+	return nil
+}
+
+// ServeHTTP reads the XML-RPC call, invokes the service method and writes the response.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "rpc: POST method required, received "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := newServerRequest(r, h.codecs)
+	s.mapError = h.mapError
+	s.debug, s.logger = h.debug, h.logger
+	if s.err != nil {
+		s.WriteError(w, http.StatusBadRequest, s.err)
+		return
+	}
+
+	svc, m := h.get(s.call.Method)
+	if m == nil {
+		s.WriteError(w, http.StatusBadRequest, MethodNotFound.New(""))
+		return
+	}
+
+	args := reflect.New(m.argsType)
+	if err := s.ReadRequest(args.Interface()); err != nil {
+		s.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var next MethodHandler = func(r *http.Request, method string, args interface{}) (reply interface{}, err error) {
+		replyVal := reflect.New(m.replyType)
+		out := m.method.Func.Call([]reflect.Value{svc.receiver, reflect.ValueOf(r), reflect.ValueOf(args), replyVal})
+		err, _ = out[0].Interface().(error)
+		return replyVal.Interface(), err
+	}
+	h.mtx.RLock()
+	for i := len(h.middleware) - 1; i >= 0; i-- {
+		next = h.middleware[i](next)
+	}
+	h.mtx.RUnlock()
+
+	reply, err := s.invoke(next, args.Interface())
+	if err != nil {
+		s.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.WriteResponse(w, reply)
+}
+
+// get returns the service and method for a name such as "Arith.Add"
+func (h *Handler) get(name string) (*service, *serviceMethod) {
+	parts := strings.Split(name, ".")
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	s, ok := h.services[parts[0]]
+	if !ok {
+		return nil, nil
+	}
+	return s, s.methods[parts[1]]
+}
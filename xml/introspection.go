@@ -0,0 +1,85 @@
+package xml
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	listMethodsMethod = "system.listMethods"
+	methodHelpMethod  = "system.methodHelp"
+	signatureMethod   = "system.methodSignature"
+
+	// reply of system.methodSignature for methods without a signature
+	signaturesNotSupported = "signatures not supported"
+)
+
+var (
+	// errBuiltin is returned by the request for methods answered by the codec.
+	// gorilla/rpc does not dispatch the request and writes the error, which writes the reply instead.
+	errBuiltin = errors.New("rpc: built-in method")
+)
+
+// RegisterMethods register the names of service methods, such as "Arith.Add",
+// which are reported by system.listMethods along with their aliases.
+func (c *ServerCodec) RegisterMethods(methods []string) {
+	c.methods = append(c.methods, methods...)
+}
+
+// SetMethodHelp set the help text returned by system.methodHelp for the method.
+func (c *ServerCodec) SetMethodHelp(method, help string) {
+	c.help[method] = help
+}
+
+// SetMethodSignature set the signatures returned by system.methodSignature for the method.
+// Each signature lists the XML-RPC type names of the return value followed by the parameters,
+// for example []string{"int", "int", "int"}.
+// Methods without a signature return the string "signatures not supported".
+func (c *ServerCodec) SetMethodSignature(method string, signatures [][]string) {
+	c.signatures[method] = signatures
+}
+
+// builtin returns the reply for a built-in method
+func (c *ServerCodec) builtin(s *serverRequest) (interface{}, bool) {
+	switch s.call.Method {
+	case listMethodsMethod:
+		return c.listMethods(), true
+	case methodHelpMethod:
+		var method string
+		if err := s.call.rpcParams.writeTo(&method, &s.cfg); err != nil {
+			return InvalidParams.New(err.Error()), true
+		}
+		// unknown methods have no help
+		return c.help[method], true
+	case signatureMethod:
+		var method string
+		if err := s.call.rpcParams.writeTo(&method, &s.cfg); err != nil {
+			return InvalidParams.New(err.Error()), true
+		}
+		if signatures, ok := c.signatures[method]; ok {
+			return signatures, true
+		}
+		return signaturesNotSupported, true
+	}
+	return nil, false
+}
+
+// listMethods returns the sorted names of registered and built-in methods
+func (c *ServerCodec) listMethods() []string {
+	methods := []string{listMethodsMethod, methodHelpMethod, signatureMethod}
+	for _, m := range c.methods {
+		methods = append(methods, m)
+		parts := strings.Split(m, ".")
+		if len(parts) != 2 {
+			continue
+		}
+		for alias, method := range c.aliases {
+			if method == parts[1] {
+				methods = append(methods, parts[0]+"."+alias)
+			}
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
@@ -0,0 +1,37 @@
+package xml
+
+import (
+	"bytes"
+)
+
+// Marshaler is the interface implemented by types that can marshal themselves
+// into a value that is encoded in their place.
+type Marshaler interface {
+	MarshalRPC() (interface{}, error)
+}
+
+// Unmarshaler is the interface implemented by types that can unmarshal a decoded value
+// of themselves. The value is given as a native Go type with arrays as []interface{}
+// and structs as map[string]interface{}.
+type Unmarshaler interface {
+	UnmarshalRPC(value interface{}) error
+}
+
+// Marshal returns the XML-RPC encoding of v as a <value> element.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := withCodec(func(c *Codec) error {
+		return c.writeRPC(&buf, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal parses the XML-RPC encoded <value> element and stores the result in the value pointed to by v.
+func Unmarshal(data []byte, v interface{}) error {
+	return withCodec(func(c *Codec) error {
+		return c.readRPC(bytes.NewReader(data), v)
+	})
+}
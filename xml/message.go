@@ -1,8 +1,14 @@
 package xml
 
 import (
+	"encoding"
 	"fmt"
+	"math"
+	"math/big"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,6 +30,8 @@ var (
 	// precomputed types
 	typeOfValue     = reflect.TypeOf((*reflect.Value)(nil)).Elem()
 	typeOfInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+	typeOfTime      = reflect.TypeOf(time.Time{})
+	typeOfBigInt    = reflect.TypeOf(big.Int{})
 )
 
 // XML-RPC request
@@ -38,6 +46,19 @@ type methodResponse struct {
 	rpcFault
 }
 
+// fault returns the fault of the response, nil when the response is not a fault,
+// or the error writing the fault
+func (r *methodResponse) fault(cfg *codecConfig) error {
+	if r.Fault.isEmpty() {
+		return nil
+	}
+	var fault Fault
+	if err := r.Fault.writeTo(&fault, cfg); err != nil {
+		return err
+	}
+	return fault
+}
+
 // XML-RPC params
 type rpcParams struct {
 	Params []rpcValue
@@ -61,50 +82,210 @@ type rpcEntry struct {
 }
 
 // makeCall creates a new method call
-func makeCall(method string, params ...interface{}) methodCall {
+func makeCall(cfg *codecConfig, method string, params ...interface{}) (methodCall, error) {
 	var r methodCall
+	var err error
 	r.Method = method
-	r.Params = makeParams(params...)
-	return r
+	r.Params, err = makeParams(cfg, params...)
+	return r, err
 }
 
 // makeResponse create a new response. Response is a fault if argument is error or of type Fault
-func makeResponse(value interface{}) methodResponse {
+func makeResponse(cfg *codecConfig, value interface{}) (methodResponse, error) {
 	var r methodResponse
+	var err error
 	switch v := value.(type) {
 	case Fault:
-		r.Fault = makeValue(v)
+		r.Fault, err = makeValue(v, cfg)
 	case error:
-		r.Fault = makeValue(InternalError.New(v.Error()))
+		r.Fault, err = makeValue(InternalError.New(v.Error()), cfg)
 	default:
-		r.Params = makeParams(v)
+		r.Params, err = makeParams(cfg, v)
 	}
-	return r
+	return r, err
 }
 
 // makeParams creates an slice of XML-RPC values
-func makeParams(args ...interface{}) []rpcValue {
+func makeParams(cfg *codecConfig, args ...interface{}) ([]rpcValue, error) {
 	if len(args) == 0 {
-		return nil
+		return nil, nil
 	}
 	arr := make([]rpcValue, 0, len(args))
 	for _, v := range args {
-		arr = append(arr, makeValue(v))
+		item, err := makeValue(v, cfg)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, item)
+	}
+	return arr, nil
+}
+
+// expandStruct returns the values of the struct fields in declaration order to send as positional params
+func expandStruct(arg interface{}, cfg *codecConfig) ([]interface{}, error) {
+	refVal := reflect.Indirect(reflect.ValueOf(arg))
+	if refVal.Kind() != reflect.Struct {
+		return nil, InvalidParams.New("expected a struct to expand into params got '%T'", arg)
+	}
+	// fields are read from an addressable copy since nil embedded pointers are allocated
+	copied := reflect.New(refVal.Type()).Elem()
+	copied.Set(refVal)
+
+	order := fieldOrder(nil, refVal.Type(), nil, cfg.tag())
+	params := make([]interface{}, 0, len(order))
+	for _, index := range order {
+		fieldVal, err := fieldByIndex(copied, index)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, fieldVal.Interface())
+	}
+	return params, nil
+}
+
+// tagOptions is the comma-separated list of options following the name in an rpc struct tag
+type tagOptions string
+
+// lookupTag returns the tag of the struct field for the key falling back to the json tag when absent
+func lookupTag(field reflect.StructField, key string) string {
+	if tag, ok := field.Tag.Lookup(key); ok {
+		return tag
+	}
+	return field.Tag.Get("json")
+}
+
+// fieldTag returns the member name of the struct field and the tag options.
+// The tag name is preferred if available. An empty name means the field is excluded with "-"
+func fieldTag(field reflect.StructField, key string) (string, tagOptions) {
+	tag := lookupTag(field, key)
+	if tag == "-" {
+		return "", ""
+	}
+	name, opts := tag, ""
+	if i := strings.Index(tag, ","); i != -1 {
+		name, opts = tag[:i], tag[i+1:]
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name, tagOptions(opts)
+}
+
+// has reports whether the option is in the list
+func (o tagOptions) has(option string) bool {
+	for _, s := range strings.Split(string(o), ",") {
+		if s == option {
+			return true
+		}
+	}
+	return false
+}
+
+// value returns the value of an option of the form name=value in the list
+func (o tagOptions) value(name string) (string, bool) {
+	for _, s := range strings.Split(string(o), ",") {
+		if strings.HasPrefix(s, name+"=") {
+			return s[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// isEmptyValue reports whether the value is empty for the omitempty option
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// mapKeyName converts a map key to a struct member name
+func mapKeyName(key reflect.Value) string {
+	if key.Kind() == reflect.String {
+		return key.String()
+	}
+	if s, ok := key.Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(key.Float(), 'g', -1, key.Type().Bits())
+	case reflect.Bool:
+		return strconv.FormatBool(key.Bool())
+	default:
+		return fmt.Sprint(key.Interface())
 	}
-	return arr
 }
 
 // makeValue creates a new XML-RPC value from the given user value
-func makeValue(value interface{}) rpcValue {
+func makeValue(value interface{}, cfg *codecConfig) (rpcValue, error) {
 	var r rpcValue
 
 	// empty value
 	if value == nil {
-		return r
+		return r, nil
 	}
 
-	// dereference in case of pointer values
+	// dereference in case of pointer values. nil pointers are empty values
 	refVal := reflect.ValueOf(value)
+	if refVal.Kind() == reflect.Ptr && refVal.IsNil() {
+		return r, nil
+	}
+
+	// values are encoded unchanged
+	switch v := value.(type) {
+	case *Value:
+		return v.rpc, nil
+	case Value:
+		return v.rpc, nil
+	}
+
+	// custom marshalers provide the value to encode
+	if m, ok := value.(Marshaler); ok {
+		v, err := m.MarshalRPC()
+		if err != nil {
+			return r, err
+		}
+		return makeValue(v, cfg)
+	}
+
+	// big integers are encoded as integers when they fit in 64 bits and as strings otherwise
+	if reflect.Indirect(refVal).Type() == typeOfBigInt {
+		n, ok := value.(*big.Int)
+		if !ok {
+			v := value.(big.Int)
+			n = &v
+		}
+		if n.IsInt64() {
+			return rpcValue{value: n.Int64(), kind: intKind}, nil
+		}
+		return rpcValue{value: n.String(), kind: stringKind}, nil
+	}
+
+	// text marshalers are encoded as strings except for time which is a dateTime
+	if m, ok := value.(encoding.TextMarshaler); ok && reflect.Indirect(refVal).Type() != typeOfTime {
+		text, err := m.MarshalText()
+		if err != nil {
+			return r, err
+		}
+		return rpcValue{value: string(text), kind: stringKind}, nil
+	}
+
 	if refVal.Kind() == reflect.Ptr {
 		refVal = reflect.Indirect(refVal)
 		value = refVal.Interface()
@@ -113,17 +294,32 @@ func makeValue(value interface{}) rpcValue {
 	r.value = value
 	r.kind = nilKind
 
-	switch value.(type) {
+	switch v := value.(type) {
 	case bool:
 		r.kind = booleanKind
 	case int, int64, int32, int16, uint, uint64, uint32, uint16, uint8:
+		if n := reflect.ValueOf(v); n.Kind() == reflect.Uint64 && n.Uint() > math.MaxInt64 {
+			return r, InvalidParams.New("integer %d overflows i8", n.Uint())
+		}
 		r.kind = intKind
 	case float64, float32:
+		// rejected before any output is written since XML-RPC cannot represent them
+		if f := reflect.ValueOf(v).Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+			return r, InvalidParams.New("double %v is not supported", f)
+		}
 		r.kind = doubleKind
 	case string:
 		r.kind = stringKind
 	case []byte:
 		r.kind = base64Kind
+		if cfg.byteSliceAsArray {
+			var array []rpcValue
+			for _, b := range v {
+				array = append(array, rpcValue{value: int(b), kind: intKind})
+			}
+			r.value = array
+			r.kind = arrayKind
+		}
 	case time.Time:
 		r.kind = dateTimeKind
 	default:
@@ -140,7 +336,10 @@ func makeValue(value interface{}) rpcValue {
 
 			array = make([]rpcValue, 0, size)
 			for i := 0; i < size; i++ {
-				item := makeValue(refVal.Index(i).Interface())
+				item, err := makeValue(refVal.Index(i).Interface(), cfg)
+				if err != nil {
+					return r, err
+				}
 				array = append(array, item)
 			}
 			r.value = array
@@ -156,13 +355,22 @@ func makeValue(value interface{}) rpcValue {
 
 			members = make([]rpcEntry, 0, len(mapKeys))
 			for _, key := range mapKeys {
+				item, err := makeValue(refVal.MapIndex(key).Interface(), cfg)
+				if err != nil {
+					return r, err
+				}
 				entry := rpcEntry{
-					Name:  fmt.Sprintf("%s", key.Interface()),
-					Value: makeValue(refVal.MapIndex(key).Interface()),
+					Name:  mapKeyName(key),
+					Value: item,
 				}
 				members = append(members, entry)
 			}
 
+			// sort members for a stable output
+			sort.Slice(members, func(i, j int) bool {
+				return members[i].Name < members[j].Name
+			})
+
 			r.value = members
 		case reflect.Struct:
 			var members []rpcEntry
@@ -174,34 +382,176 @@ func makeValue(value interface{}) rpcValue {
 				break
 			}
 
-			refType := refVal.Type()
-			members = make([]rpcEntry, 0, nFields)
-			for i := 0; i < nFields; i++ {
-				// get the struct field description
-				field := refType.Field(i)
-				entry := rpcEntry{
-					Name:  field.Name,
-					Value: makeValue(refVal.FieldByName(field.Name).Interface()),
-				}
-				// prefer tags if available
-				if tagName, ok := field.Tag.Lookup("rpc"); ok {
-					entry.Name = tagName
-				}
-				members = append(members, entry)
+			members, err := appendMembers(make([]rpcEntry, 0, nFields), refVal, cfg)
+			if err != nil {
+				return r, err
 			}
 
 			r.value = members
 			r.kind = structKind
 		}
 	}
-	return r
+	return r, nil
+}
+
+// appendMembers appends the struct fields as members.
+// Fields of embedded structs without an rpc tag name are promoted into the parent
+func appendMembers(members []rpcEntry, refVal reflect.Value, cfg *codecConfig) ([]rpcEntry, error) {
+	refType := refVal.Type()
+	for i := 0; i < refVal.NumField(); i++ {
+		// get the struct field description
+		field := refType.Field(i)
+		fieldVal := refVal.Field(i)
+		name, opts := fieldTag(field, cfg.tag())
+		if name == "" || opts.has("omitempty") && isEmptyValue(fieldVal) {
+			continue
+		}
+		if isPromoted(field, cfg.tag()) {
+			if fieldVal.Kind() == reflect.Ptr {
+				if fieldVal.IsNil() {
+					continue
+				}
+				fieldVal = fieldVal.Elem()
+			}
+			var err error
+			if members, err = appendMembers(members, fieldVal, cfg); err != nil {
+				return members, err
+			}
+			continue
+		}
+		item, err := makeValue(fieldVal.Interface(), cfg)
+		if err != nil {
+			return members, err
+		}
+		entry := rpcEntry{
+			Name:  name,
+			Value: item,
+		}
+		members = append(members, entry)
+	}
+	return members, nil
+}
+
+// isPromoted reports whether the fields of an embedded struct are promoted into the parent struct
+func isPromoted(field reflect.StructField, key string) bool {
+	if !field.Anonymous || strings.Split(lookupTag(field, key), ",")[0] != "" {
+		return false
+	}
+	t := field.Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t != typeOfTime
+}
+
+// fieldIndexes maps member names to the index paths of the struct fields.
+// Fields of the struct take precedence over fields promoted from embedded structs.
+// The lowercase names are also mapped when foldMap is not nil
+func fieldIndexes(nameMap, foldMap map[string][]int, refType reflect.Type, parent []int, key string) {
+	walkFieldIndexes(nameMap, foldMap, refType, parent, key, map[reflect.Type]bool{refType: true})
+}
+
+// walkFieldIndexes maps the fields of the struct and then the structs it embeds.
+// Each struct type is visited once so types embedding themselves through a pointer terminate
+func walkFieldIndexes(nameMap, foldMap map[string][]int, refType reflect.Type, parent []int, key string, visited map[reflect.Type]bool) {
+	var embedded []int
+	for i := 0; i < refType.NumField(); i++ {
+		field := refType.Field(i)
+		name, _ := fieldTag(field, key)
+		if name == "" {
+			continue
+		}
+		if isPromoted(field, key) {
+			embedded = append(embedded, i)
+			continue
+		}
+		index := append(append([]int{}, parent...), i)
+		if _, ok := nameMap[name]; !ok {
+			nameMap[name] = index
+		}
+		if _, ok := foldMap[strings.ToLower(name)]; !ok && foldMap != nil {
+			foldMap[strings.ToLower(name)] = index
+		}
+	}
+	for _, i := range embedded {
+		t := refType.Field(i).Type
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if visited[t] {
+			continue
+		}
+		visited[t] = true
+		walkFieldIndexes(nameMap, foldMap, t, append(append([]int{}, parent...), i), key, visited)
+	}
+}
+
+// fieldOrder appends the index paths of the exported struct fields in declaration order.
+// Fields promoted from embedded structs take the position of the embedded struct
+func fieldOrder(order [][]int, refType reflect.Type, parent []int, key string) [][]int {
+	return walkFieldOrder(order, refType, parent, key, map[reflect.Type]bool{refType: true})
+}
+
+// walkFieldOrder appends the index paths visiting each embedded struct type once
+func walkFieldOrder(order [][]int, refType reflect.Type, parent []int, key string, visited map[reflect.Type]bool) [][]int {
+	for i := 0; i < refType.NumField(); i++ {
+		field := refType.Field(i)
+		name, _ := fieldTag(field, key)
+		if name == "" || field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		index := append(append([]int{}, parent...), i)
+		if isPromoted(field, key) {
+			t := field.Type
+			if t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if !visited[t] {
+				visited[t] = true
+				order = walkFieldOrder(order, t, index, key, visited)
+			}
+			continue
+		}
+		order = append(order, index)
+	}
+	return order
+}
+
+// fieldByIndex returns the nested field for the index path allocating nil embedded pointers.
+// A nil embedded pointer to an unexported struct type cannot be allocated and is an error
+func fieldByIndex(refVal reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && refVal.Kind() == reflect.Ptr {
+			if refVal.IsNil() {
+				if !refVal.CanSet() {
+					return reflect.Value{}, InternalError.New("error writing struct. cannot set embedded pointer to unexported struct '%s'", refVal.Type().Elem())
+				}
+				refVal.Set(reflect.New(refVal.Type().Elem()))
+			}
+			refVal = refVal.Elem()
+		}
+		refVal = refVal.Field(x)
+	}
+	return refVal, nil
+}
+
+// isStructTarget reports whether the pointer value points to a struct through any number of pointers
+func isStructTarget(v interface{}) bool {
+	t := reflect.TypeOf(v)
+	if rv, ok := v.(*reflect.Value); ok && rv.IsValid() {
+		t = reflect.PtrTo(rv.Type())
+	}
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t != nil && t.Kind() == reflect.Struct && t != typeOfTime && t != typeOfValue
 }
 
 // writeTo writes the XML-RPC value to the given pointer value
-func (r *rpcValue) writeTo(v interface{}) error {
+func (r *rpcValue) writeTo(v interface{}, cfg *codecConfig) error {
 
-	// nothing to write
-	if r == nil || r.isEmpty() {
+	// nothing to write. an empty struct is still written to a struct for the default values of its fields
+	if r == nil || r.isEmpty() && !(r.kind == structKind && isStructTarget(v)) {
 		return nil
 	}
 
@@ -219,8 +569,8 @@ func (r *rpcValue) writeTo(v interface{}) error {
 	refKind := refType.Kind()
 	refVal := refPtrVal.Elem()
 
-	if refKind == reflect.Interface {
-		return InternalError.New("error writing value. cannot write to type '%s'", refPtrKind)
+	if refKind == reflect.Interface && refType != typeOfInterface {
+		return InternalError.New("error writing value. cannot write to type '%s'", refType)
 	}
 
 	if refType == typeOfValue {
@@ -233,25 +583,68 @@ func (r *rpcValue) writeTo(v interface{}) error {
 		return InternalError.New("error writing to value. cannot set value")
 	}
 
+	// custom unmarshalers decode the value themselves
+	if refVal.CanAddr() {
+		if u, ok := refVal.Addr().Interface().(Unmarshaler); ok {
+			return u.UnmarshalRPC(r.native())
+		}
+		if refType == typeOfBigInt {
+			return r.writeBigInt(refVal.Addr().Interface().(*big.Int))
+		}
+		// strings are decoded by text unmarshalers except for time which is a dateTime
+		if u, ok := refVal.Addr().Interface().(encoding.TextUnmarshaler); ok && r.kind == stringKind && refType != typeOfTime {
+			if err := u.UnmarshalText([]byte(r.value.(string))); err != nil {
+				return InternalError.New("error writing text. %s", err)
+			}
+			return nil
+		}
+	}
+
+	// generic values are written as native Go types
+	if refType == typeOfInterface {
+		refVal.Set(reflect.ValueOf(r.native()))
+		return nil
+	}
+
+	// pointers are allocated as needed and the value written to the pointee
+	if refKind == reflect.Ptr {
+		if refVal.IsNil() {
+			refVal.Set(reflect.New(refType.Elem()))
+		}
+		elem := refVal.Elem()
+		return r.writeTo(&elem, cfg)
+	}
+
+	// loosely typed values are converted when the kinds differ
+	if cfg.weakTyping {
+		if ok, err := r.writeWeak(refVal); ok {
+			return err
+		}
+	}
+
 	var err error
 	val := r.value
 
 	switch r.kind {
 	case arrayKind:
-		if refType == typeOfInterface {
-			// we have an array of generic types. nothing sensible can be done at this point
-			// expect the user to know how to interpret the values
-			break
+		array, ok := r.value.([]rpcValue)
+		if !ok {
+			return InternalError.New("invalid decoded type for array")
+		}
+
+		if refKind == reflect.Array {
+			return writeArray(array, refVal, cfg)
+		}
+
+		if refKind == reflect.Struct && cfg.arrayAsStruct {
+			return writePositional(array, refVal, cfg)
 		}
 
 		if refKind != reflect.Slice {
-			return InternalError.New("error writing value. expected type slice got '%s'", refKind)
+			return InternalError.New("error writing value. expected type slice or array got '%s'", refKind)
 		}
+
 		// make our slice
-		array, ok := r.value.([]rpcValue)
-		if !ok {
-			return InternalError.New("invalid decoded type for array")
-		}
 
 		size := len(array)
 		slice := reflect.MakeSlice(refType, size, size)
@@ -259,48 +652,91 @@ func (r *rpcValue) writeTo(v interface{}) error {
 		// update our data items
 		for i, item := range array {
 			m := slice.Index(i)
-			if err = item.writeTo(&m); err != nil {
+			if err = item.writeTo(&m, cfg); err != nil {
 				return err
 			}
 		}
 		// append the new slice to the dereferenced slice
 		val = reflect.AppendSlice(refVal, slice).Interface()
 	case structKind:
-		if refKind != reflect.Struct {
-			return InternalError.New("error writing struct. expected type struct got '%s'", refKind)
-		}
-
 		members, ok := r.value.([]rpcEntry)
 		if !ok {
 			return InternalError.New("invalid decoded type for struct")
 		}
 
-		nfields := refType.NumField()
-		nameMap := make(map[string]string, nfields)
-		for i := 0; i < nfields; i++ {
-			field := refType.Field(i)
-			if name, ok := field.Tag.Lookup("rpc"); ok {
-				nameMap[name] = field.Name
-			} else {
-				nameMap[field.Name] = field.Name
-			}
+		if refKind == reflect.Map {
+			return writeMap(members, refVal, cfg)
 		}
 
+		if refKind != reflect.Struct {
+			return InternalError.New("error writing struct. expected type struct got '%s'", refKind)
+		}
+
+		nameMap := make(map[string][]int, refType.NumField())
+		var foldMap map[string][]int
+		if cfg.caseInsensitive {
+			foldMap = make(map[string][]int, refType.NumField())
+		}
+		fieldIndexes(nameMap, foldMap, refType, nil, cfg.tag())
+
+		// index paths of the fields written from members
+		written := make(map[string]bool, len(members))
 		for _, member := range members {
-			fieldName := nameMap[member.Name]
-			fieldVal := refVal.FieldByName(nameMap[member.Name])
+			index, ok := nameMap[member.Name]
+			if !ok && foldMap != nil {
+				// exact matches take priority over case-insensitive matches
+				index, ok = foldMap[strings.ToLower(member.Name)]
+			}
 
 			// field may not exist, report early to avoid panics
-			if !fieldVal.IsValid() {
-				return InternalError.New("error writing struct. unknown field %s", fieldName)
+			if !ok {
+				if cfg.allowUnknownFields {
+					continue
+				}
+				return InternalError.New("error writing struct. unknown field %s", member.Name)
+			}
+			fieldVal, err := fieldByIndex(refVal, index)
+			if err != nil {
+				return err
 			}
 
-			if err = member.Value.writeTo(&fieldVal); err != nil {
+			if err = member.Value.writeTo(&fieldVal, cfg); err != nil {
 				return err
 			}
+			written[fmt.Sprint(index)] = true
+		}
+
+		// defaults are written to the fields of absent members only
+		if err = writeDefaults(nameMap, written, refVal, cfg); err != nil {
+			return err
 		}
 
 		val = refVal.Interface()
+	case base64Kind:
+		// decoded bytes may be written to strings
+		if refKind == reflect.String {
+			b, _ := val.([]byte)
+			val = reflect.ValueOf(string(b)).Convert(refType).Interface()
+		}
+	case intKind:
+		// integers may be written to any integer type large enough to hold the value
+		n := reflect.ValueOf(val)
+		i, ok := intValue(val)
+		if n.Type() == refType || !ok {
+			break
+		}
+		switch refKind {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if refVal.OverflowInt(i) {
+				return InternalError.New("error writing int. %d overflows '%s'", i, refType)
+			}
+			val = n.Convert(refType).Interface()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if i < 0 || refVal.OverflowUint(uint64(i)) {
+				return InternalError.New("error writing int. %d overflows '%s'", i, refType)
+			}
+			val = n.Convert(refType).Interface()
+		}
 	}
 
 	if err != nil {
@@ -320,8 +756,219 @@ func (r *rpcValue) writeTo(v interface{}) error {
 	return nil
 }
 
+// writeWeak converts strings to numbers and booleans and numbers to strings for the value.
+// Reports whether the conversion applies to the kinds of the XML-RPC value and the Go value
+func (r *rpcValue) writeWeak(refVal reflect.Value) (bool, error) {
+	refKind := refVal.Kind()
+	switch r.kind {
+	case stringKind:
+		s := strings.TrimSpace(r.value.(string))
+		switch refKind {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || refVal.OverflowInt(n) {
+				return true, InternalError.New("error writing string. cannot convert '%s' to '%s'", s, refVal.Type())
+			}
+			refVal.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseUint(s, 10, 64)
+			if err != nil || refVal.OverflowUint(n) {
+				return true, InternalError.New("error writing string. cannot convert '%s' to '%s'", s, refVal.Type())
+			}
+			refVal.SetUint(n)
+		case reflect.Float32, reflect.Float64:
+			f, err := strconv.ParseFloat(s, refVal.Type().Bits())
+			if err != nil {
+				return true, InternalError.New("error writing string. cannot convert '%s' to '%s'", s, refVal.Type())
+			}
+			refVal.SetFloat(f)
+		case reflect.Bool:
+			b, ok := boolDecodeMap[strings.ToLower(s)]
+			if !ok {
+				return true, InternalError.New("error writing string. cannot convert '%s' to '%s'", s, refVal.Type())
+			}
+			refVal.SetBool(b)
+		default:
+			return false, nil
+		}
+	case intKind:
+		if refKind != reflect.String {
+			return false, nil
+		}
+		i, _ := intValue(r.value)
+		refVal.SetString(strconv.FormatInt(i, 10))
+	case doubleKind:
+		if refKind != reflect.String {
+			return false, nil
+		}
+		refVal.SetString(formatDouble(r.value))
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// memberNames adds the names of the struct members to names including nested members prefixed with the parent name
+func (r *rpcValue) memberNames(names map[string]bool, prefix string) {
+	members, ok := r.value.([]rpcEntry)
+	if r.kind != structKind || !ok {
+		return
+	}
+	for _, m := range members {
+		name := prefix + m.Name
+		names[name] = true
+		m.Value.memberNames(names, name+".")
+	}
+}
+
+// writeArray writes the elements to a Go array of the same length
+func writeArray(array []rpcValue, refVal reflect.Value, cfg *codecConfig) error {
+	if len(array) != refVal.Len() {
+		return InternalError.New("error writing array. expected %d elements for '%s' got %d", refVal.Len(), refVal.Type(), len(array))
+	}
+	for i, item := range array {
+		elem := refVal.Index(i)
+		if err := item.writeTo(&elem, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePositional writes the elements to the struct fields in declaration order.
+// Fields without an element are left unchanged
+func writePositional(array []rpcValue, refVal reflect.Value, cfg *codecConfig) error {
+	order := fieldOrder(nil, refVal.Type(), nil, cfg.tag())
+	if len(array) > len(order) && !cfg.allowUnknownFields {
+		return InternalError.New("error writing struct. expected at most %d elements for '%s' got %d", len(order), refVal.Type(), len(array))
+	}
+	for i, index := range order {
+		if i == len(array) {
+			break
+		}
+		fieldVal, err := fieldByIndex(refVal, index)
+		if err != nil {
+			return err
+		}
+		if err := array[i].writeTo(&fieldVal, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultValue returns the value of the default option. Options are separated by commas
+// so a default value cannot contain one. Text following the default which is not a known option is an error
+func (o tagOptions) defaultValue() (string, bool, error) {
+	def, ok := o.value("default")
+	if !ok {
+		return "", false, nil
+	}
+	opts := strings.Split(string(o), ",")
+	for i, s := range opts {
+		if !strings.HasPrefix(s, "default=") {
+			continue
+		}
+		for _, next := range opts[i+1:] {
+			if next != "omitempty" {
+				return "", false, fmt.Errorf("default value '%s,%s' cannot contain a comma", def, next)
+			}
+		}
+		break
+	}
+	return def, true, nil
+}
+
+// writeDefaults writes the values of the default tag options to the struct fields not written from members.
+// A default value cannot contain a comma since it separates the tag options
+func writeDefaults(nameMap map[string][]int, written map[string]bool, refVal reflect.Value, cfg *codecConfig) error {
+	for _, index := range nameMap {
+		field := refVal.Type().FieldByIndex(index)
+		_, opts := fieldTag(field, cfg.tag())
+		def, ok, err := opts.defaultValue()
+		if err != nil {
+			return InternalError.New("error writing struct. invalid tag of field '%s'. %s", field.Name, err)
+		}
+		if !ok || written[fmt.Sprint(index)] {
+			continue
+		}
+		fieldVal, err := fieldByIndex(refVal, index)
+		if err != nil {
+			return err
+		}
+		if fieldVal.Kind() == reflect.Ptr {
+			if fieldVal.IsNil() {
+				fieldVal.Set(reflect.New(fieldVal.Type().Elem()))
+			}
+			fieldVal = fieldVal.Elem()
+		}
+		if fieldVal.Kind() == reflect.String {
+			fieldVal.SetString(def)
+			continue
+		}
+		// defaults are parsed like strings sent for numeric and boolean fields
+		str := rpcValue{value: def, kind: stringKind}
+		if ok, err := str.writeWeak(fieldVal); !ok {
+			return InternalError.New("error writing struct. unsupported default for '%s'", fieldVal.Type())
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMap writes the struct members to a map with string keys
+func writeMap(members []rpcEntry, refVal reflect.Value, cfg *codecConfig) error {
+	refType := refVal.Type()
+	if refType.Key().Kind() != reflect.String {
+		return InternalError.New("error writing struct. expected map with string keys got '%s'", refType)
+	}
+	if refVal.IsNil() {
+		refVal.Set(reflect.MakeMapWithSize(refType, len(members)))
+	}
+	for _, member := range members {
+		elem := reflect.New(refType.Elem()).Elem()
+		if err := member.Value.writeTo(&elem, cfg); err != nil {
+			return err
+		}
+		key := reflect.ValueOf(member.Name).Convert(refType.Key())
+		refVal.SetMapIndex(key, elem)
+	}
+	return nil
+}
+
+// intValue returns the signed or unsigned integer of an int value.
+// Unsigned values made from Go values are at most math.MaxInt64
+func intValue(v interface{}) (int64, bool) {
+	n := reflect.ValueOf(v)
+	switch n.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return n.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(n.Uint()), true
+	}
+	return 0, false
+}
+
+// writeBigInt writes an integer or a string of decimal digits to the big integer
+func (r *rpcValue) writeBigInt(n *big.Int) error {
+	switch r.kind {
+	case intKind:
+		i, _ := intValue(r.value)
+		n.SetInt64(i)
+	case stringKind:
+		s := strings.TrimSpace(r.value.(string))
+		if _, ok := n.SetString(s, 10); !ok {
+			return InternalError.New("error writing big integer '%s'", s)
+		}
+	default:
+		return InternalError.New("error writing big integer. unexpected value %v", r.value)
+	}
+	return nil
+}
+
 // writes parameters to the receiver
-func (r *rpcParams) writeTo(args interface{}) error {
+func (r *rpcParams) writeTo(args interface{}, cfg *codecConfig) error {
 	if args == nil || r == nil || len(r.Params) == 0 {
 		return nil
 	}
@@ -335,13 +982,36 @@ func (r *rpcParams) writeTo(args interface{}) error {
 
 	// if we have a single value write it
 	if len(r.Params) == 1 {
-		return r.Params[0].writeTo(args)
+		return r.Params[0].writeTo(args, cfg)
 	}
 
 	// otherwie, we are decoding multiple params
 	sliceVal := val.Elem()
 	array := rpcValue{value: r.Params, kind: arrayKind}
-	return array.writeTo(&sliceVal)
+	return array.writeTo(&sliceVal, cfg)
+}
+
+// native returns the value as a native Go type.
+// Arrays are returned as []interface{} and structs as map[string]interface{}
+func (r rpcValue) native() interface{} {
+	switch r.kind {
+	case arrayKind:
+		array, _ := r.value.([]rpcValue)
+		values := make([]interface{}, 0, len(array))
+		for _, v := range array {
+			values = append(values, v.native())
+		}
+		return values
+	case structKind:
+		members, _ := r.value.([]rpcEntry)
+		values := make(map[string]interface{}, len(members))
+		for _, m := range members {
+			values[m.Name] = m.Value.native()
+		}
+		return values
+	default:
+		return r.value
+	}
 }
 
 func (r rpcValue) isEmpty() bool {
@@ -0,0 +1,77 @@
+package xml
+
+import (
+	"context"
+	"io"
+)
+
+const multiCallMethod = "system.multicall"
+
+// MultiCallItem is a single call in a system.multicall batch.
+// The result of the call is written to Reply if it is not nil.
+type MultiCallItem struct {
+	Method string
+	Args   []interface{}
+	Reply  interface{}
+}
+
+// XML-RPC system.multicall entry
+type multiCall struct {
+	Method string        `rpc:"methodName"`
+	Params []interface{} `rpc:"params"`
+}
+
+// MultiCall sends a batch of calls to the server in a single system.multicall request.
+// The result of each call is written to its Reply and the returned slice holds, in order,
+// either nil or the Fault returned for that call.
+// A transport error or a fault for the whole request fails the batch and is returned as the error.
+func (c *Client) MultiCall(calls []MultiCallItem) ([]error, error) {
+	params := make([]multiCall, 0, len(calls))
+	for _, call := range calls {
+		params = append(params, multiCall{Method: call.Method, Params: call.Args})
+	}
+
+	errs := make([]error, len(calls))
+	err := c.do(context.Background(), multiCallMethod, nil, encodeCall(multiCallMethod, []interface{}{params}), func(codec *Codec, r io.Reader) error {
+		var res methodResponse
+		if err := codec.readRPC(r, &res); err != nil {
+			return err
+		}
+
+		if err := res.fault(&codec.cfg); err != nil {
+			return err
+		}
+
+		if len(res.Params) != 1 || res.Params[0].kind != arrayKind {
+			return InvalidRequest.New("expected an array of results for '%s'", multiCallMethod)
+		}
+		results, _ := res.Params[0].value.([]rpcValue)
+		if len(results) != len(calls) {
+			return InvalidRequest.New("expected %d results for '%s' got %d", len(calls), multiCallMethod, len(results))
+		}
+
+		for i, result := range results {
+			switch result.kind {
+			case structKind:
+				var fault Fault
+				if err := result.writeTo(&fault, &codec.cfg); err != nil {
+					return err
+				}
+				errs[i] = fault
+			case arrayKind:
+				values, _ := result.value.([]rpcValue)
+				if len(values) > 0 && calls[i].Reply != nil {
+					errs[i] = values[0].writeTo(calls[i].Reply, &codec.cfg)
+				}
+			default:
+				return InvalidRequest.New("invalid result at index %d for '%s'", i, multiCallMethod)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
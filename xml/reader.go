@@ -1,6 +1,7 @@
 package xml
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/xml"
 	"fmt"
@@ -12,39 +13,63 @@ import (
 
 const (
 	iso8601         = "20060102T15:04:05"
+	iso8601Nano     = "20060102T15:04:05.999999999"
+	iso8601TZ       = "20060102T15:04:05Z07:00"
 	rfc3339NoTZ     = "2006-01-02T15:04:05"
 	rfc3339HyphenTZ = "2006-01-02T15:04:05-07:00"
 )
 
 var (
-	dateTimeFormats = [4]string{iso8601, time.RFC3339, rfc3339HyphenTZ, rfc3339NoTZ}
-	boolDecodeMap   = map[string]bool{"1": true, "true": true, "0": false, "false": false}
-	valueTagSet     = map[string]bool{}
+	dateTimeFormats = [7]string{iso8601, iso8601Nano, iso8601TZ, time.RFC3339, time.RFC3339Nano, rfc3339HyphenTZ, rfc3339NoTZ}
+	boolDecodeMap   = map[string]bool{
+		"1": true, "true": true, "t": true, "yes": true, "on": true,
+		"0": false, "false": false, "f": false, "no": false, "off": false,
+	}
+	valueTagSet = map[string]bool{}
+	// value tags outside the base XML-RPC spec rejected in strict mode
+	extensionTagSet = map[string]bool{"nil": true, "i8": true}
+	utf8BOM         = []byte("\xef\xbb\xbf")
 )
 
 // reads an XML-RPC input from an io.Reader
 type xmlReader struct {
-	dec  *xml.Decoder // for XML pull parsing
-	peek xml.Token    // next token we peeked
+	dec   *xml.Decoder // for XML pull parsing
+	peek  xml.Token    // next token we peeked
+	cfg   *codecConfig
+	depth int  // current nesting of values
+	count int  // number of values read
+	start bool // at the start of the input
 }
 
 func init() {
-	for _, t := range [8]xmlTag{stringTag, intTag, base64Tag, dateTimeTag, doubleTag, booleanTag, arrayTag, structTag} {
+	for _, t := range [11]xmlTag{stringTag, intTag, i4Tag, base64Tag, dateTimeTag, doubleTag, booleanTag, arrayTag, structTag, nilTag, i8Tag} {
 		valueTagSet[tagNames[t]] = true
 	}
-	valueTagSet["i4"] = true //alternative for int tags
 }
 
 func newReader(r io.Reader) *xmlReader {
-	return &xmlReader{
-		dec: xml.NewDecoder(r),
-	}
+	rd := &xmlReader{cfg: &codecConfig{}}
+	rd.reset(r)
+	return rd
 }
 
 // resets the reader internal state
 func (r *xmlReader) reset(rd io.Reader) {
 	r.peek = nil
+	r.depth = 0
+	r.count = 0
+	r.start = true
 	r.dec = xml.NewDecoder(rd)
+	r.dec.CharsetReader = charsetReader
+}
+
+// charsetReader accepts ASCII input which is a subset of UTF-8 and rejects other declared encodings
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "us-ascii", "ascii":
+		return input, nil
+	}
+	return nil, UnsupportedEncoding.New("unsupported encoding '%s'", charset)
 }
 
 func (r *xmlReader) readHeader() error {
@@ -148,6 +173,11 @@ func (r *xmlReader) readValue(rpc *rpcValue) error {
 		return err
 	}
 
+	if err = r.enter(); err != nil {
+		return err
+	}
+	defer func() { r.depth-- }()
+
 	// determine the type of value
 	se, err := r.nextStart()
 	if err != nil {
@@ -164,7 +194,10 @@ func (r *xmlReader) readValue(rpc *rpcValue) error {
 	}
 
 	if !valueTagSet[se.Name.Local] {
-		return fmt.Errorf("parsing error. expected valid rpc value element got '%s'", se.Name.Local)
+		return r.errorf("parsing error. expected valid rpc value element got '%s'", se.Name.Local)
+	}
+	if r.cfg.strict && extensionTagSet[se.Name.Local] {
+		return InvalidRequest.New("value element '%s' is not allowed in strict mode", se.Name.Local)
 	}
 
 	r.putToken(se)
@@ -186,6 +219,41 @@ func (r *xmlReader) readValue(rpc *rpcValue) error {
 	return r.expectEnd("value")
 }
 
+// readArrayStream reads the next array value calling fn for each element in order
+func (r *xmlReader) readArrayStream(fn func(int, *rpcValue) error) error {
+	err := r.expectStart("value")
+	if err != nil {
+		return err
+	}
+
+	if err = r.enter(); err != nil {
+		return err
+	}
+	defer func() { r.depth-- }()
+
+	if err = r.readElements(fn); err != nil {
+		return err
+	}
+	return r.expectEnd("value")
+}
+
+// enter guards against deeply nested input and input with too many values.
+// The caller must decrement the depth when done with the value
+func (r *xmlReader) enter() error {
+	maxDepth := r.cfg.maxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxDepth
+	}
+	if r.depth++; r.depth > maxDepth {
+		return MalformedInput.New("maximum depth of %d exceeded", maxDepth)
+	}
+
+	if r.count++; r.cfg.maxElements > 0 && r.count > r.cfg.maxElements {
+		return MalformedInput.New("maximum of %d elements exceeded", r.cfg.maxElements)
+	}
+	return nil
+}
+
 // readPrimitive reads the next primitive value
 func (r *xmlReader) readPrimitive(rpc *rpcValue) error {
 	// assume start is valid since we always come via readValue()
@@ -194,11 +262,51 @@ func (r *xmlReader) readPrimitive(rpc *rpcValue) error {
 		return err
 	}
 
-	s, _ := r.nextText()
+	// empty elements like <nil/> or <int></int> are followed by their end without char data
+	empty, err := r.emptyElement(se.Name.Local)
+	if err != nil {
+		return err
+	}
+	var s string
+	if !empty {
+		if s, err = r.nextText(); err != nil {
+			return err
+		}
+	}
 	if err = r.expectEnd(se.Name.Local); err != nil {
 		return err
 	}
 
+	// empty primitives like <int/> are the zero value of the type
+	if empty {
+		switch se.Name.Local {
+		case "boolean":
+			rpc.value, rpc.kind = false, booleanKind
+			return nil
+		case "int", "i4", "i8":
+			rpc.value, rpc.kind = 0, intKind
+			return nil
+		case "double":
+			rpc.value, rpc.kind = 0.0, doubleKind
+			return nil
+		case "dateTime.iso8601":
+			rpc.value, rpc.kind = time.Time{}, dateTimeKind
+			return nil
+		}
+	}
+
+	// empty numeric content such as <int></int> is zero when enabled
+	if r.cfg.emptyNumericAsZero && strings.TrimSpace(s) == "" {
+		switch se.Name.Local {
+		case "int", "i4", "i8":
+			rpc.value, rpc.kind = 0, intKind
+			return nil
+		case "double":
+			rpc.value, rpc.kind = 0.0, doubleKind
+			return nil
+		}
+	}
+
 	var ok bool
 
 	switch se.Name.Local {
@@ -206,7 +314,8 @@ func (r *xmlReader) readPrimitive(rpc *rpcValue) error {
 		rpc.value = s
 		rpc.kind = stringKind
 	case "boolean":
-		if rpc.value, ok = boolDecodeMap[s]; !ok {
+		// accept common spellings in any case
+		if rpc.value, ok = boolDecodeMap[strings.ToLower(strings.TrimSpace(s))]; !ok {
 			return InvalidRequest.New("error writing boolean '%s'", s)
 		}
 		rpc.kind = booleanKind
@@ -215,6 +324,11 @@ func (r *xmlReader) readPrimitive(rpc *rpcValue) error {
 			return InvalidRequest.New("error writing int '%s'", s)
 		}
 		rpc.kind = intKind
+	case "i8":
+		if rpc.value, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return InvalidRequest.New("error writing i8 '%s'", s)
+		}
+		rpc.kind = intKind
 	case "double":
 		if rpc.value, err = strconv.ParseFloat(s, 64); err != nil {
 			return InvalidRequest.New("error writing double '%s'", s)
@@ -224,31 +338,64 @@ func (r *xmlReader) readPrimitive(rpc *rpcValue) error {
 		rpc.value, err = base64.StdEncoding.DecodeString(s)
 		rpc.kind = base64Kind
 	case "dateTime.iso8601":
-		for _, dateFmt := range dateTimeFormats {
-			if rpc.value, err = time.Parse(dateFmt, s); err == nil {
-				break
-			}
-		}
+		rpc.value, err = r.parseDateTime(s)
 		rpc.kind = dateTimeKind
+	case "nil":
+		rpc.value = nil
+		rpc.kind = nilKind
 	default:
-		return fmt.Errorf("unhandled tag. '%s'", se.Name.Local)
+		return r.errorf("unhandled tag. '%s'", se.Name.Local)
 	}
 	return err
 }
 
+// parseDateTime parses a dateTime value trying the registered formats before the defaults
+func (r *xmlReader) parseDateTime(s string) (t time.Time, err error) {
+	// values without a zone are in the default location
+	loc := r.cfg.location
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, formats := range [2][]string{r.cfg.dateTimeFormats, dateTimeFormats[:]} {
+		for _, dateFmt := range formats {
+			if t, err = time.ParseInLocation(dateFmt, s, loc); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return t, err
+}
+
 // readArray reads an array value
 func (r *xmlReader) readArray(rpc *rpcValue) error {
-	r.nextStart() // <array>
+	var array []rpcValue
 
-	// <data>
-	err := r.expectStart("data")
+	err := r.readElements(func(_ int, val *rpcValue) error {
+		array = append(array, *val)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	var array []rpcValue
+	rpc.value = array
+	rpc.kind = arrayKind
+	return nil
+}
 
-	for {
+// readElements reads the elements of an array calling fn for each value in order
+func (r *xmlReader) readElements(fn func(int, *rpcValue) error) error {
+	// <array><data>
+	err := r.expectStart("array")
+	if err != nil {
+		return err
+	}
+	if err = r.expectStart("data"); err != nil {
+		return err
+	}
+
+	var val rpcValue
+	for i := 0; ; i++ {
 		se, err := r.nextStart()
 		if err != nil {
 			// empty array is allowed although just a waste of bytes
@@ -257,23 +404,22 @@ func (r *xmlReader) readArray(rpc *rpcValue) error {
 
 		// we expect every start element to be a value
 		if se.Name.Local != "value" {
-			return fmt.Errorf("parsing error. invalid element '%s'", se.Name.Local)
+			return r.errorf("parsing error. invalid element '%s'", se.Name.Local)
 		}
 
 		// read the values
-		var val rpcValue
+		val = rpcValue{}
 
 		r.putToken(se)
 		if err := r.readValue(&val); err != nil {
 			return err
 		}
 
-		array = append(array, val)
+		if err := fn(i, &val); err != nil {
+			return err
+		}
 	}
 
-	rpc.value = array
-	rpc.kind = arrayKind
-
 	err = r.expectEnd("data")
 	if err != nil {
 		return err
@@ -327,17 +473,44 @@ func (r *xmlReader) readStruct(rpc *rpcValue) error {
 	return r.expectEnd("struct")
 }
 
-// nextText read the required next token as text. treat empty text as an error
+// nextText read the required next token as text. treat empty text as an error.
+// consecutive chardata tokens such as text split by CDATA sections are joined
 func (r *xmlReader) nextText() (string, error) {
 	t, err := r.token()
 	if t == nil {
 		return "", err
 	}
-	if cd, ok := t.(xml.CharData); ok {
-		return string(cd), nil
+	cd, ok := t.(xml.CharData)
+	if !ok {
+		r.putToken(t)
+		return "", r.errorf("expected chardata but got '%#v'", t)
+	}
+
+	text := string(cd)
+	for {
+		t, _ = r.token()
+		if t == nil {
+			break
+		}
+		if cd, ok = t.(xml.CharData); !ok {
+			r.putToken(t)
+			break
+		}
+		text += string(cd)
+	}
+	return text, nil
+}
+
+// emptyElement reports whether the next token is the end of the element with the name.
+// The token is kept to be read again
+func (r *xmlReader) emptyElement(name string) (bool, error) {
+	t, err := r.token()
+	if t == nil {
+		return false, err
 	}
 	r.putToken(t)
-	return "", fmt.Errorf("expected chardata but got '%#v'", t)
+	end, ok := t.(xml.EndElement)
+	return ok && end.Name.Local == name, nil
 }
 
 // nextStart return the next token expected as an xml.StartElement
@@ -351,7 +524,7 @@ func (r *xmlReader) nextStart() (xml.StartElement, error) {
 		return se, nil
 	}
 	r.putToken(t)
-	return xml.StartElement{}, fmt.Errorf("expected start element but got '%s'", t)
+	return xml.StartElement{}, r.errorf("expected start element but got '%s'", t)
 }
 
 // nextEnd return the next token expected as an xml.EndElement
@@ -365,7 +538,7 @@ func (r *xmlReader) nextEnd() (xml.EndElement, error) {
 		return end, nil
 	}
 	r.putToken(t)
-	return xml.EndElement{}, fmt.Errorf("expected end element but got '%s'", t)
+	return xml.EndElement{}, r.errorf("expected end element but got '%s'", t)
 }
 
 // expect a start element with the given name
@@ -376,7 +549,7 @@ func (r *xmlReader) expectStart(name string) error {
 	}
 	if se.Name.Local != name {
 		r.putToken(se)
-		return fmt.Errorf("parsing error. expected start element '%s' but got '%s'", name, se.Name.Local)
+		return r.errorf("parsing error. expected start element '%s' but got '%s'", name, se.Name.Local)
 	}
 	return nil
 }
@@ -389,19 +562,34 @@ func (r *xmlReader) expectEnd(name string) error {
 	}
 	if end.Name.Local != name {
 		r.putToken(end)
-		return fmt.Errorf("parsing error. expected end element '%s' but got '%s'", name, end.Name.Local)
+		return r.errorf("parsing error. expected end element '%s' but got '%s'", name, end.Name.Local)
 	}
 	return nil
 }
 
-// token returns the next token from the XML stream
+// token returns the next token from the XML stream skipping comments
 func (r *xmlReader) token() (xml.Token, error) {
 	if r.peek != nil {
 		t := r.peek
 		r.peek = nil
 		return t, nil
 	}
-	return r.dec.RawToken()
+	for {
+		t, err := r.dec.RawToken()
+		if r.start {
+			// strip a leading UTF-8 byte-order mark
+			r.start = false
+			if cd, ok := t.(xml.CharData); ok && bytes.HasPrefix(cd, utf8BOM) {
+				if cd = cd[len(utf8BOM):]; len(cd) == 0 {
+					continue
+				}
+				t = cd
+			}
+		}
+		if _, ok := t.(xml.Comment); !ok {
+			return t, err
+		}
+	}
 }
 
 func (r *xmlReader) trim() {
@@ -417,6 +605,11 @@ func (r *xmlReader) trim() {
 	}
 }
 
+// errorf returns a parsing error reporting the offset of the input read so far
+func (r *xmlReader) errorf(format string, v ...interface{}) error {
+	return fmt.Errorf(format+" at offset %d", append(v, r.dec.InputOffset())...)
+}
+
 // pushes the token on the top of decoding stream
 func (r *xmlReader) putToken(t xml.Token) {
 	r.peek = t
@@ -1,8 +1,15 @@
 package xml
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"mime"
 	"net/http"
+	"runtime/debug"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/rpc/v2"
 )
@@ -13,23 +20,103 @@ const (
 	serviceNotFound = "rpc: can't find service"
 )
 
+// content types of XML-RPC requests accepted by the server
+var contentTypes = []string{"text/xml", "application/xml"}
+
 // ServerCodec codec compatible with gorilla/rpc to process each request.
+//
+// Service methods receive the original *http.Request, so request-scoped values,
+// deadlines and cancellation are available from r.Context().
 type ServerCodec struct {
-	aliases map[string]string
+	aliases    map[string]string
+	methods    []string
+	help       map[string]string
+	signatures map[string][][]string
+	mapError   func(error) (Fault, bool)
+	codecs     *sync.Pool
+	debug      bool
+	logger     *log.Logger
 }
 
 // serverRequest handles reading request and writing response
 type serverRequest struct {
-	header http.Header
-	call   methodCall
-	err    error
+	request  *http.Request
+	call     methodCall
+	err      error
+	codecs   *sync.Pool
+	cfg      codecConfig
+	reply    interface{} // reply of a built-in method
+	mapError func(error) (Fault, bool)
+	debug    bool
+	logger   *log.Logger
 }
 
 // NewServerCodec return a new XML-RPC severCodec compatible with "gorilla/rpc".
 func NewServerCodec() *ServerCodec {
-	return &ServerCodec{aliases: make(map[string]string)}
+	return &ServerCodec{
+		aliases:    make(map[string]string),
+		help:       make(map[string]string),
+		signatures: make(map[string][][]string),
+		codecs:     codecPool,
+	}
+}
+
+// Register register the codec with the server for the "text/xml" and "application/xml" content types.
+// Responses have the same content type as the request.
+func (c *ServerCodec) Register(server *rpc.Server) {
+	for _, contentType := range contentTypes {
+		server.RegisterCodec(c, contentType)
+	}
+}
+
+// SetCodec configure the codec settings used to read requests and write responses.
+// The settings are copied so later changes to the codec do not affect the server codec.
+func (c *ServerCodec) SetCodec(codec *Codec) {
+	c.codecs = newCodecPool(codec)
+}
+
+// SetErrorMapper configure a function translating errors returned by service methods to faults.
+// It is consulted for errors which are not faults before they are reported as an InternalError.
+func (c *ServerCodec) SetErrorMapper(mapper func(error) (Fault, bool)) {
+	c.mapError = mapper
+}
+
+// SetDebugFaults configure the codec to include the text of errors which are not faults in the InternalError
+// returned to the client. Faults have a generic message by default to avoid exposing internals.
+func (c *ServerCodec) SetDebugFaults(enable bool) {
+	c.debug = enable
+}
+
+// SetLogger configure the logger of errors reported to the client as an InternalError.
+// Errors are logged with the standard logger by default.
+func (c *ServerCodec) SetLogger(logger *log.Logger) {
+	c.logger = logger
 }
 
+// Recover returns a handler serving requests with next, usually the gorilla/rpc server the codec is registered with,
+// which reports a panic in a service method to the client as an InternalError fault.
+// The panic is logged and its value and stack are only sent to the client with debug faults.
+func (c *ServerCodec) Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &serverRequest{codecs: c.codecs, debug: c.debug, logger: c.logger}
+		// the codec records the method name of the request for the log and fault
+		r = r.WithContext(context.WithValue(r.Context(), methodNameKey{}, &s.call.Method))
+		s.request = r
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				s.WriteResponse(w, s.panicFault(p))
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// methodNameKey is the context key of the method name recorded for a request served by ServerCodec.Recover
+type methodNameKey struct{}
+
 // RegisterAlias register a method alias.
 func (c *ServerCodec) RegisterAlias(alias, method string) {
 	c.aliases[alias] = method
@@ -37,11 +124,9 @@ func (c *ServerCodec) RegisterAlias(alias, method string) {
 
 // NewRequest returns a new codec request.
 func (c *ServerCodec) NewRequest(r *http.Request) rpc.CodecRequest {
-	s := &serverRequest{header: r.Header}
-
-	s.err = withCodec(func(c *Codec) error {
-		return c.readRPC(r.Body, &s.call)
-	})
+	s := newServerRequest(r, c.codecs)
+	s.mapError = c.mapError
+	s.debug, s.logger = c.debug, c.logger
 
 	// resolve aliases
 	parts := strings.Split(s.call.Method, ".")
@@ -52,6 +137,32 @@ func (c *ServerCodec) NewRequest(r *http.Request) rpc.CodecRequest {
 		}
 	}
 
+	if method, ok := r.Context().Value(methodNameKey{}).(*string); ok {
+		*method = s.call.Method
+	}
+
+	// answer built-in methods without dispatching to a service
+	if s.err == nil {
+		if reply, ok := c.builtin(s); ok {
+			s.reply, s.err = reply, errBuiltin
+		}
+	}
+
+	return s
+}
+
+// newServerRequest reads the XML-RPC call from the request body
+func newServerRequest(r *http.Request, codecs *sync.Pool) *serverRequest {
+	s := &serverRequest{request: r, codecs: codecs}
+	s.err = withPooledCodec(s.codecs, func(c *Codec) error {
+		s.cfg = c.cfg
+		body, err := newDecompressor(r.Body, r.Header)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		return c.readRPC(body, &s.call)
+	})
 	return s
 }
 
@@ -60,37 +171,115 @@ func (s *serverRequest) Method() (string, error) {
 	return s.call.Method, s.err
 }
 
+// contentType returns the content type of the response in the same family as the request
+func (s *serverRequest) contentType() string {
+	mediaType, _, _ := mime.ParseMediaType(s.request.Header.Get("Content-Type"))
+	if mediaType == "application/xml" {
+		return "application/xml; charset=utf-8"
+	}
+	return "text/xml; charset=utf-8"
+}
+
 // ReadRequest reads the XML-RPC request and writes the arguments to the receiver.
 func (s *serverRequest) ReadRequest(args interface{}) error {
-	return s.call.rpcParams.writeTo(args)
+	return s.call.rpcParams.writeTo(args, &s.cfg)
 }
 
 // WriteResponse write an XML-RPC response to reply receiver.
+// The response is encoded to a buffer first so a reply which cannot be encoded is reported as a fault.
 func (s *serverRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
-	withCodec(func(c *Codec) error {
-		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
-		zw := newCompressor(w, s.header)
-		c.writeResponse(zw, reply)
-		if closer, _ := zw.(*compressWriter); closer != nil {
-			closer.Close()
-		}
-		return nil
+	withPooledCodec(s.codecs, func(c *Codec) error {
+		return withBuffer(func(buf *bytes.Buffer) error {
+			if err := c.writeResponse(buf, reply); err != nil {
+				buf.Reset()
+				var fault Fault
+				if !errors.As(err, &fault) {
+					fault = s.internalFault(err)
+				}
+				if err = c.writeResponse(buf, fault); err != nil {
+					return err
+				}
+			}
+
+			w.Header().Set("Content-Type", s.contentType())
+			zw := newCompressor(w, s.request.Header)
+			_, err := buf.WriteTo(zw)
+			if closer, _ := zw.(*compressWriter); closer != nil {
+				if cerr := closer.Close(); err == nil {
+					err = cerr
+				}
+			}
+			return err
+		})
 	})
 }
 
 // WriteError write an XML-RPC Fault.
 func (s *serverRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	// built-in methods are reported as errors to skip dispatching
+	if err == errBuiltin {
+		s.WriteResponse(w, s.reply)
+		return
+	}
+
 	// XML-RPC always send 200 OK responses
-	switch v := err.(type) {
-	case Fault:
-		s.WriteResponse(w, v)
-	default:
-		if strings.HasPrefix(err.Error(), methodNotFound) || strings.HasPrefix(v.Error(), serviceNotFound) {
-			s.WriteResponse(w, MethodNotFound.New(""))
-		} else {
-			// service functions should return appropriate XML-RPC faults
-			// wrap any other error as internal
-			s.WriteResponse(w, InternalError.New(err.Error()))
+	var fault Fault
+	if errors.As(err, &fault) {
+		s.WriteResponse(w, fault)
+	} else if fault, ok := s.mappedFault(err); ok {
+		s.WriteResponse(w, fault)
+	} else if strings.HasPrefix(err.Error(), methodNotFound) || strings.HasPrefix(err.Error(), serviceNotFound) {
+		s.WriteResponse(w, MethodNotFound.New(""))
+	} else {
+		// service functions should return appropriate XML-RPC faults
+		// wrap any other error as internal
+		s.WriteResponse(w, s.internalFault(err))
+	}
+}
+
+// invoke calls the method handler with the arguments reporting a panic in the handler,
+// including any middleware, as an InternalError fault
+func (s *serverRequest) invoke(next MethodHandler, args interface{}) (reply interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			reply, err = nil, s.panicFault(p)
 		}
+	}()
+	return next(s.request, s.call.Method, args)
+}
+
+// panicFault logs the recovered panic and returns an InternalError fault with the panic value and stack only in debug mode
+func (s *serverRequest) panicFault(p interface{}) Fault {
+	stack := debug.Stack()
+	logf(s.logger, "rpc: panic serving %s: %v\n%s", s.call.Method, p, stack)
+	if s.debug {
+		return InternalError.New("panic serving %s: %v\n%s", s.call.Method, p, stack)
+	}
+	return InternalError.New("")
+}
+
+// internalFault logs the error and returns an InternalError fault with the error text only in debug mode
+func (s *serverRequest) internalFault(err error) Fault {
+	logf(s.logger, "rpc: error serving %s: %v", s.call.Method, err)
+	if s.debug {
+		return InternalError.New(err.Error())
+	}
+	return InternalError.New("")
+}
+
+// mappedFault translates the error with the configured error mapper
+func (s *serverRequest) mappedFault(err error) (Fault, bool) {
+	if s.mapError == nil {
+		return Fault{}, false
+	}
+	return s.mapError(err)
+}
+
+// logf logs with the logger or the standard logger when nil
+func logf(logger *log.Logger, format string, v ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, v...)
+		return
 	}
+	log.Printf(format, v...)
 }
@@ -1,13 +1,37 @@
 package xml
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/gorilla/rpc/v2"
+	"github.com/klauspost/compress/zstd"
 )
 
 type PositionalArgs []interface{}
@@ -41,6 +65,30 @@ func (t *Arith) Div(r *http.Request, args *Args, reply *Reply) error {
 	return nil
 }
 
+func (t *Arith) Sqrt(r *http.Request, args *Args, reply *Reply) error {
+	if args.A < 0 {
+		return fmt.Errorf("sqrt: %w", InvalidParams.New("negative number"))
+	}
+	reply.C = int(math.Sqrt(float64(args.A)))
+	return nil
+}
+
+// traceKey is the context key of the trace ID
+type traceKey struct{}
+
+func (t *Arith) Trace(r *http.Request, args *Args, reply *string) error {
+	*reply, _ = r.Context().Value(traceKey{}).(string)
+	return nil
+}
+
+func (t *Arith) Panic(r *http.Request, args *Args, reply *Reply) error {
+	panic("boom")
+}
+
+func (t *Arith) Open(r *http.Request, args *string, reply *Reply) error {
+	return fmt.Errorf("open %s: %w", *args, os.ErrNotExist)
+}
+
 func (t *Arith) Max(r *http.Request, args *NumericArgs, reply *Reply) error {
 	params := *args
 	if len(params) == 0 {
@@ -78,6 +126,14 @@ func createConn() (*http.Server, *Client) {
 	return &http.Server{Addr: address, Handler: s}, client
 }
 
+// newTestServer returns a test server for the Arith service using the given codec
+func newTestServer(codec *ServerCodec) *httptest.Server {
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "text/xml")
+	s.RegisterService(new(Arith), "Arith")
+	return httptest.NewServer(s)
+}
+
 func Test_ClientServer(t *testing.T) {
 	server, c := createConn()
 	defer server.Shutdown(context.Background())
@@ -126,3 +182,1236 @@ func Test_ClientServer(t *testing.T) {
 	assertNotEqual(t, nil, err, "error for unknown method")
 	assertEqual(t, int(MethodNotFound), fault.Code, "method not found")
 }
+
+func Test_ClientTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	var reply Reply
+	c := NewClient(ts.URL, WithTimeout(50*time.Millisecond))
+	err := c.Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	terr, ok := err.(TimeoutError)
+	assertOk(t, ok, "expect timeout error")
+	assertEqual(t, "Arith.Add", terr.Method, "timeout method")
+	assertOk(t, terr.Timeout(), "timeout flag")
+
+	body := []byte("<methodCall><methodName>Arith.Add</methodName><params></params></methodCall>")
+	err = c.CallRaw(context.Background(), body, &reply)
+	terr, ok = err.(TimeoutError)
+	assertOk(t, ok, "expect raw call timeout error")
+	assertEqual(t, "Arith.Add", terr.Method, "raw call timeout method")
+
+	// the deadline of the caller is not reported as a client timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = NewClient(ts.URL).CallRaw(ctx, body, &reply)
+	_, ok = err.(TimeoutError)
+	assertOk(t, !ok, "caller deadline is not a timeout error")
+	assertOk(t, errors.Is(err, context.DeadlineExceeded), "caller deadline exceeded")
+	assertEqual(t, "call to 'Arith.Add' stopped: context deadline exceeded", err.Error(), "caller deadline message")
+
+	_, err = NewClient(ts.URL, WithTimeout(time.Second)).Do(ctx, "Arith.Add")
+	assertOk(t, errors.Is(err, context.DeadlineExceeded), "caller deadline before client timeout")
+}
+
+func Test_ClientMultiCall(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var call methodCall
+		withCodec(func(c *Codec) error {
+			return c.readRPC(r.Body, &call)
+		})
+		assertEqual(t, "system.multicall", call.Method, "multicall method name")
+		assertEqual(t, 1, len(call.Params), "multicall single param")
+
+		w.Write([]byte("<methodResponse><params><param><value><array><data>" +
+			"<value><array><data><value><struct><member><name>C</name><value><int>6</int></value></member></struct></value></data></array></value>" +
+			"<value><struct><member><name>faultCode</name><value><int>-32602</int></value></member>" +
+			"<member><name>faultString</name><value><string>divide by zero</string></value></member></struct></value>" +
+			"</data></array></value></param></params></methodResponse>"))
+	}))
+	defer ts.Close()
+
+	var add, div Reply
+	c := NewClient(ts.URL)
+	errs, err := c.MultiCall([]MultiCallItem{
+		{Method: "Arith.Add", Args: []interface{}{Args{A: 3, B: 3}}, Reply: &add},
+		{Method: "Arith.Div", Args: []interface{}{Args{A: 1, B: 0}}, Reply: &div},
+	})
+	assertEqual(t, nil, err, "multicall no error")
+	assertEqual(t, 2, len(errs), "multicall results")
+	assertEqual(t, nil, errs[0], "first call succeeds")
+	assertEqual(t, 6, add.C, "first call result")
+	assertEqual(t, InvalidParams.New("divide by zero"), errs[1], "second call fault")
+}
+
+func Test_ListMethods(t *testing.T) {
+	codec := NewServerCodec()
+	codec.RegisterAlias("add", "Add")
+	codec.RegisterMethods([]string{"Arith.Add", "Arith.Mul", "Arith.Div", "Arith.Max", "Arith.Count"})
+	ts := newTestServer(codec)
+	defer ts.Close()
+
+	var methods []string
+	err := NewClient(ts.URL).Call("system.listMethods", &methods)
+	assertEqual(t, nil, err, "list methods no error")
+	assertEqual(t, []string{"Arith.Add", "Arith.Count", "Arith.Div", "Arith.Max", "Arith.Mul", "Arith.add", "system.listMethods", "system.methodHelp", "system.methodSignature"}, methods, "list methods")
+}
+
+func Test_MethodHelp(t *testing.T) {
+	codec := NewServerCodec()
+	codec.SetMethodHelp("Arith.Add", "Add two numbers")
+	ts := newTestServer(codec)
+	defer ts.Close()
+
+	var help string
+	c := NewClient(ts.URL)
+	err := c.Call("system.methodHelp", &help, "Arith.Add")
+	assertEqual(t, nil, err, "method help no error")
+	assertEqual(t, "Add two numbers", help, "method help")
+
+	help = "-"
+	err = c.Call("system.methodHelp", &help, "Arith.Mul")
+	assertEqual(t, nil, err, "unknown method help no error")
+	assertEqual(t, "", help, "unknown method help")
+}
+
+func Test_MethodSignature(t *testing.T) {
+	codec := NewServerCodec()
+	codec.SetMethodSignature("Arith.Add", [][]string{{"struct", "struct"}})
+	codec.SetMethodSignature("Arith.Max", [][]string{{"struct", "int"}, {"struct", "int", "int"}})
+	ts := newTestServer(codec)
+	defer ts.Close()
+
+	var signatures [][]string
+	c := NewClient(ts.URL)
+	err := c.Call("system.methodSignature", &signatures, "Arith.Max")
+	assertEqual(t, nil, err, "method signature no error")
+	assertEqual(t, [][]string{{"struct", "int"}, {"struct", "int", "int"}}, signatures, "method signature")
+
+	var unsupported string
+	err = c.Call("system.methodSignature", &unsupported, "Arith.Mul")
+	assertEqual(t, nil, err, "unknown method signature no error")
+	assertEqual(t, "signatures not supported", unsupported, "unknown method signature")
+}
+
+func Test_ClientHTTPError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("<html>server error</html>"))
+	}))
+	defer ts.Close()
+
+	var reply Reply
+	err := NewClient(ts.URL).Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	httpErr, ok := err.(HTTPError)
+	assertOk(t, ok, "expect http error")
+	assertEqual(t, http.StatusInternalServerError, httpErr.StatusCode, "http error status")
+	assertEqual(t, "<html>server error</html>", httpErr.Body, "http error body")
+}
+
+func Test_RequestCompression(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewServerCodec(), "text/xml")
+	s.RegisterService(new(Arith), "Arith")
+
+	var encoding string
+	var raw []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		raw, _ = ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(raw))
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	// the bytes on the wire are decompressed independently of the package
+	decompress := map[string]func(io.Reader) (io.Reader, error){
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return flate.NewReader(r), nil },
+		"zstd":    func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for enc, newReader := range decompress {
+		var reply Reply
+		err := NewClient(ts.URL, WithRequestCompression(enc)).Call("Arith.Add", &reply, Args{A: 2, B: 3})
+		assertEqual(t, nil, err, "compressed request no error ", enc)
+		assertEqual(t, enc, encoding, "request content encoding ", enc)
+		assertEqual(t, 5, reply.C, "compressed request ", enc)
+
+		assertOk(t, !bytes.Contains(raw, []byte("methodCall")), "request body not plain text ", enc)
+		zr, err := newReader(bytes.NewReader(raw))
+		assertEqual(t, nil, err, "wire body header ", enc)
+		body, err := ioutil.ReadAll(zr)
+		assertEqual(t, nil, err, "wire body decompressed ", enc)
+		assertOk(t, bytes.Contains(body, []byte("<methodName>Arith.Add</methodName>")), "wire body compressed ", enc)
+	}
+
+	// a body which is not compressed as declared is malformed
+	req, _ := http.NewRequest("POST", ts.URL, strings.NewReader("<methodCall><methodName>Arith.Add</methodName></methodCall>"))
+	req.Header.Set("Content-Type", "text/xml")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	assertEqual(t, nil, err, "invalid gzip request no error")
+	var reply Reply
+	err = NewDecoder(resp.Body).DecodeResponse(&reply)
+	resp.Body.Close()
+	assertOk(t, errors.Is(err, MalformedInput), "invalid gzip body reported as malformed input")
+}
+
+// closeRecorder records whether the reader was closed
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func Test_CompressionRoundTrip(t *testing.T) {
+	payload := createXML(1000, "Allan Watt")
+	for _, enc := range []string{"gzip", "deflate", "zstd"} {
+		// pooled writers and readers are reused across iterations
+		for i := 0; i < 3; i++ {
+			var buf bytes.Buffer
+			zw := newCompressWriter(&buf, enc)
+			io.WriteString(zw, payload)
+			assertEqual(t, nil, zw.Close(), "compress no error ", enc)
+			assertOk(t, buf.Len() < len(payload)/5, "payload compressed ", enc)
+
+			header := make(http.Header)
+			header.Set("Content-Encoding", enc)
+			body := &closeRecorder{Reader: &buf}
+			zr, err := newDecompressor(body, header)
+			assertEqual(t, nil, err, "decompressor no error ", enc)
+			b, err := ioutil.ReadAll(zr)
+			zr.Close()
+			assertEqual(t, nil, err, "decompress no error ", enc)
+			assertEqual(t, payload, string(b), "decompressed payload ", enc)
+			assertOk(t, body.closed, "body closed with decompressor ", enc)
+		}
+	}
+}
+
+func Test_FaultErrors(t *testing.T) {
+	ts := newTestServer(NewServerCodec())
+	defer ts.Close()
+
+	var reply Reply
+	c := NewClient(ts.URL)
+	err := c.Call("Arith.Sqrt", &reply, Args{A: -4})
+	assertEqual(t, InvalidParams.New("negative number"), err, "wrapped fault written by server")
+
+	wrapped := fmt.Errorf("call failed: %w", err)
+	var fault Fault
+	assertOk(t, errors.As(wrapped, &fault), "errors.As wrapped fault")
+	assertEqual(t, int(InvalidParams), fault.Code, "errors.As fault code")
+	assertOk(t, errors.Is(wrapped, Fault{Code: int(InvalidParams)}), "errors.Is fault code")
+	assertOk(t, errors.Is(wrapped, InvalidParams), "errors.Is fault code constant")
+	assertOk(t, !errors.Is(wrapped, MethodNotFound), "errors.Is other fault code")
+}
+
+// flakyTransport fails the first requests before sending to the default transport.
+// Requests fail with a connection reset unless err is set
+type flakyTransport struct {
+	failures int
+	attempts int
+	err      error
+}
+
+func (t *flakyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.attempts++
+	if t.attempts <= t.failures {
+		if t.err != nil {
+			return nil, t.err
+		}
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// timeoutError is a network timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_ClientRetry(t *testing.T) {
+	ts := newTestServer(NewServerCodec())
+	defer ts.Close()
+
+	var backoffs []int
+	backoff := func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	}
+
+	transport := &flakyTransport{failures: 2}
+	c := NewClient(ts.URL, WithHTTPClient(&http.Client{Transport: transport}), WithRetry(3, backoff))
+
+	var reply Reply
+	err := c.Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertEqual(t, nil, err, "retry succeeds")
+	assertEqual(t, 3, reply.C, "retry result")
+	assertEqual(t, 3, transport.attempts, "retry attempts")
+	assertEqual(t, []int{1, 2}, backoffs, "retry backoff")
+
+	transport.attempts, transport.failures = 0, 0
+	err = c.Call("Arith.Div", &reply, Args{A: 1, B: 0})
+	assertEqual(t, InvalidParams.New("divide by zero"), err, "fault is returned")
+	assertEqual(t, 1, transport.attempts, "fault is not retried")
+
+	transport.attempts, transport.failures = 0, 5
+	err = c.Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertNotEqual(t, nil, err, "retry gives up")
+	assertEqual(t, 3, transport.attempts, "retry gives up after max attempts")
+
+	transport.attempts, transport.failures, transport.err = 0, 1, timeoutError{}
+	err = c.Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertEqual(t, nil, err, "network timeout is retried")
+	assertEqual(t, 2, transport.attempts, "network timeout retry attempts")
+
+	for _, failure := range []error{
+		context.Canceled,
+		x509.UnknownAuthorityError{},
+		&tls.CertificateVerificationError{Err: x509.HostnameError{Host: "rpc.test"}},
+		errors.New("unsupported protocol scheme \"ftp\""),
+	} {
+		transport.attempts, transport.failures, transport.err = 0, 5, failure
+		err = c.Call("Arith.Add", &reply, Args{A: 1, B: 2})
+		assertNotEqual(t, nil, err, "permanent failure ", failure)
+		assertEqual(t, 1, transport.attempts, "permanent failure is not retried ", failure)
+	}
+
+	// an invalid URL fails before any request is sent
+	retried := len(backoffs)
+	err = NewClient("http://rpc.test/%zz", WithRetry(3, backoff)).Call("Arith.Add", &reply)
+	assertNotEqual(t, nil, err, "invalid URL fails")
+	assertEqual(t, retried, len(backoffs), "invalid URL is not retried")
+}
+
+func ExampleNewInMemoryTransport() {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewServerCodec(), "text/xml")
+	s.RegisterService(new(Arith), "Arith")
+
+	c := NewClient("http://arith.test/rpc", WithRoundTripper(NewInMemoryTransport(s)))
+
+	var reply Reply
+	if err := c.Call("Arith.Add", &reply, Args{A: 2, B: 3}); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(reply.C)
+	// Output: 5
+}
+
+func Test_InMemoryTransport(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Block") != "" {
+			<-release
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("<methodResponse/>"))
+	})
+	rt := NewInMemoryTransport(handler)
+
+	body := &closeRecorder{Reader: strings.NewReader("<methodCall/>")}
+	req, _ := http.NewRequest("POST", "http://rpc.test", body)
+	resp, err := rt.RoundTrip(req)
+	assertEqual(t, nil, err, "round trip no error")
+	assertEqual(t, http.StatusAccepted, resp.StatusCode, "round trip status")
+	assertEqual(t, "text/xml", resp.Header.Get("Content-Type"), "round trip header")
+	b, _ := ioutil.ReadAll(resp.Body)
+	assertEqual(t, "<methodResponse/>", string(b), "round trip body")
+	assertOk(t, body.closed, "request body closed")
+
+	// a canceled request does not wait for the handler
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ = http.NewRequestWithContext(ctx, "POST", "http://rpc.test", strings.NewReader(""))
+	req.Header.Set("X-Block", "1")
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rt.RoundTrip(req)
+		errc <- err
+	}()
+	cancel()
+	assertOk(t, errors.Is(<-errc, context.Canceled), "canceled round trip")
+	close(release)
+
+	body = &closeRecorder{Reader: strings.NewReader("")}
+	req, _ = http.NewRequestWithContext(ctx, "POST", "http://rpc.test", body)
+	_, err = rt.RoundTrip(req)
+	assertOk(t, errors.Is(err, context.Canceled), "round trip with canceled context")
+	assertOk(t, body.closed, "request body closed when canceled")
+}
+
+func Test_RequestContext(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewServerCodec(), "text/xml")
+	s.RegisterService(new(Arith), "Arith")
+	h := NewHandler()
+	h.Register(new(Arith), "")
+
+	header := make(http.Header)
+	header.Set("X-Trace-Id", "trace-123")
+
+	for _, handler := range []http.Handler{s, h} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), traceKey{}, r.Header.Get("X-Trace-Id"))
+			handler.ServeHTTP(w, r.WithContext(ctx))
+		}))
+
+		var trace string
+		err := NewClient(ts.URL, WithHTTPHeader(header)).Call("Arith.Trace", &trace, Args{})
+		assertEqual(t, nil, err, "trace no error")
+		assertEqual(t, "trace-123", trace, "read value from request context")
+		ts.Close()
+	}
+}
+
+func Test_RequestLogger(t *testing.T) {
+	ts := newTestServer(NewServerCodec())
+	defer ts.Close()
+
+	var method string
+	var body []byte
+	c := NewClient(ts.URL, WithRequestLogger(func(m string, b []byte) {
+		method, body = m, b
+	}))
+
+	var reply Reply
+	err := c.Call("Arith.Add", &reply, Args{A: 2, B: 3})
+	assertEqual(t, nil, err, "logged request no error")
+	assertEqual(t, 5, reply.C, "logged request reply")
+	assertEqual(t, "Arith.Add", method, "logged request method")
+	assertEqual(t, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		"<methodCall><methodName>Arith.Add</methodName><params><param><value><struct>"+
+		"<member><name>A</name><value><int>2</int></value></member>"+
+		"<member><name>B</name><value><int>3</int></value></member>"+
+		"</struct></value></param></params></methodCall>", string(body), "logged request body")
+
+	// the logged body is not affected by later calls reusing the buffer
+	logged := string(body)
+	c.Call("Arith.Mul", &reply, Args{A: 2, B: 3})
+	assertNotEqual(t, logged, string(body), "logged body of next request")
+	assertOk(t, strings.Contains(logged, "Arith.Add"), "logged body retained")
+}
+
+func Test_ResponseLogger(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewServerCodec(), "text/xml")
+	s.RegisterService(new(Arith), "Arith")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// compress the response regardless of the request
+		r.Header.Set("Accept-Encoding", "gzip")
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	var body []byte
+	c := NewClient(ts.URL, WithResponseLogger(func(b []byte) {
+		body = b
+	}))
+
+	var reply Reply
+	err := c.Call("Arith.Add", &reply, Args{A: 2, B: 3})
+	assertEqual(t, nil, err, "logged response no error")
+	assertEqual(t, 5, reply.C, "logged response reply")
+	assertEqual(t, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		"<methodResponse><params><param><value><struct>"+
+		"<member><name>C</name><value><int>5</int></value></member>"+
+		"</struct></value></param></params></methodResponse>", string(body), "logged decompressed response body")
+
+	// responses compressed with the encoding requested by the client are logged decompressed
+	var encoding string
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeHTTP(w, r)
+		encoding = w.Header().Get("Content-Encoding")
+	}))
+	defer cs.Close()
+	for _, enc := range []string{"gzip", "deflate", "zstd"} {
+		body = nil
+		c := NewClient(cs.URL, WithRequestCompression(enc), WithResponseLogger(func(b []byte) {
+			body = b
+		}))
+		err = c.Call("Arith.Add", &reply, Args{A: 2, B: 3})
+		assertEqual(t, nil, err, "logged compressed response no error ", enc)
+		assertEqual(t, enc, encoding, "response compressed on the wire ", enc)
+		assertOk(t, strings.HasSuffix(string(body), "<member><name>C</name><value><int>5</int></value></member></struct></value></param></params></methodResponse>"),
+			"logged decompressed response body ", enc)
+	}
+}
+
+func Test_CallWithOptions(t *testing.T) {
+	var headers []http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header)
+		w.Write([]byte("<methodResponse><params><param><value><int>1</int></value></param></params></methodResponse>"))
+	}))
+	defer ts.Close()
+
+	header := make(http.Header)
+	header.Set("X-Client", "test")
+	c := NewClient(ts.URL, WithHTTPHeader(header))
+
+	var n int
+	err := c.CallWithOptions("Arith.Add", &n, nil, WithCallHeader("Idempotency-Key", "key-1"))
+	assertEqual(t, nil, err, "call with options no error")
+	assertEqual(t, 1, n, "call with options reply")
+	err = c.Call("Arith.Add", &n)
+	assertEqual(t, nil, err, "call after options no error")
+
+	assertEqual(t, "key-1", headers[0].Get("Idempotency-Key"), "per-call header sent")
+	assertEqual(t, "test", headers[0].Get("X-Client"), "client header sent with per-call header")
+	assertEqual(t, "", headers[1].Get("Idempotency-Key"), "per-call header does not leak")
+	assertEqual(t, "test", headers[1].Get("X-Client"), "client header sent")
+}
+
+func Test_ConcurrentCallHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<methodResponse><params><param><value><string>%s</string></value></param></params></methodResponse>",
+			r.Header.Get("X-Request-Id"))
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, WithBasicAuth("user", "pass"))
+
+	var wg sync.WaitGroup
+	ids := make([]string, 20)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				c.Call("Arith.Add", &ids[i])
+				return
+			}
+			c.CallWithOptions("Arith.Add", &ids[i], nil, WithCallHeader("X-Request-Id", strconv.Itoa(i)))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, id := range ids {
+		if i%2 == 0 {
+			assertEqual(t, "", id, "request without call headers isolated")
+		} else {
+			assertEqual(t, strconv.Itoa(i), id, "request headers isolated")
+		}
+	}
+	assertEqual(t, "", c.header.Get("Authorization"), "client headers unchanged by requests")
+	assertEqual(t, "", c.header.Get("X-Request-Id"), "client headers unchanged by call headers")
+}
+
+func Test_CallRaw(t *testing.T) {
+	ts := newTestServer(NewServerCodec())
+	defer ts.Close()
+
+	body := []byte(`<?xml version="1.0"?>
+<methodCall>
+  <methodName>Arith.Mul</methodName>
+  <params><param><value><struct>
+    <member><name>A</name><value><int>4</int></value></member>
+    <member><name>B</name><value><int>5</int></value></member>
+  </struct></value></param></params>
+</methodCall>`)
+
+	var reply Reply
+	err := NewClient(ts.URL).CallRaw(context.Background(), body, &reply)
+	assertEqual(t, nil, err, "raw call no error")
+	assertEqual(t, 20, reply.C, "raw call reply")
+
+	err = NewClient(ts.URL, WithRequestCompression("gzip")).CallRaw(context.Background(), body, &reply)
+	assertEqual(t, nil, err, "compressed raw call no error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = NewClient(ts.URL).CallRaw(ctx, body, &reply)
+	assertNotEqual(t, nil, err, "raw call with canceled context")
+}
+
+func Test_ClientDo(t *testing.T) {
+	ts := newTestServer(NewServerCodec())
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	res, err := c.Do(context.Background(), "Arith.Add", Args{A: 2, B: 3})
+	assertEqual(t, nil, err, "do no error")
+	_, isFault := res.Fault()
+	assertOk(t, !isFault, "do success response is not a fault")
+	params := res.Params()
+	assertEqual(t, 1, len(params), "do success response params")
+	var reply Reply
+	assertEqual(t, nil, params[0].Decode(&reply), "decode do response param no error")
+	assertEqual(t, 5, reply.C, "decode do response param")
+
+	res, err = c.Do(context.Background(), "Arith.Div", Args{A: 1, B: 0})
+	assertEqual(t, nil, err, "do fault no error")
+	fault, isFault := res.Fault()
+	assertOk(t, isFault, "do fault response is a fault")
+	assertNotEqual(t, "", fault.Message, "do fault response message")
+	assertEqual(t, 0, len(res.Params()), "do fault response has no params")
+}
+
+func Test_ExpandedStructParams(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.Write([]byte("<methodResponse><params><param><value><int>1</int></value></param></params></methodResponse>"))
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, WithCodec(NewCodec(func(c *Codec) { c.OmitHeader(true) })))
+	args := struct {
+		Name   string `rpc:"name"`
+		Secret string `rpc:"-"`
+		Age    int    `rpc:"age,omitempty"`
+	}{Name: "Kofi", Secret: "x"}
+
+	var n int
+	err := c.CallWithOptions("user.create", &n, []interface{}{&args}, WithExpandedStruct())
+	assertEqual(t, nil, err, "expanded struct params no error")
+	assertEqual(t, "<methodCall><methodName>user.create</methodName><params>"+
+		"<param><value><string>Kofi</string></value></param>"+
+		"<param><value><int>0</int></value></param>"+
+		"</params></methodCall>", body, "struct expanded into positional params")
+
+	err = c.CallWithOptions("user.create", &n, []interface{}{"Kofi"}, WithExpandedStruct())
+	assertNotEqual(t, nil, err, "expand non-struct argument")
+
+	err = c.CallWithOptions("user.create", &n, []interface{}{args, args}, WithExpandedStruct())
+	assertNotEqual(t, nil, err, "expand multiple arguments")
+}
+
+func Test_CallMulti(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<methodResponse><params>" +
+			"<param><value><int>42</int></value></param>" +
+			"<param><value><string>Kofi</string></value></param>" +
+			"</params></methodResponse>"))
+	}))
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	var id int
+	var name string
+	err := c.CallMulti("user.get", []interface{}{&id, &name}, 1)
+	assertEqual(t, nil, err, "multiple replies no error")
+	assertEqual(t, 42, id, "first reply")
+	assertEqual(t, "Kofi", name, "second reply")
+
+	err = c.CallMulti("user.get", []interface{}{&id}, 1)
+	assertNotEqual(t, nil, err, "fewer replies than params")
+
+	err = c.CallMulti("user.get", []interface{}{&id, &name, &name}, 1)
+	assertNotEqual(t, nil, err, "more replies than params")
+
+	err = c.CallMulti("user.get", []interface{}{id, name}, 1)
+	assertNotEqual(t, nil, err, "non-pointer replies")
+
+	fs := newTestServer(NewServerCodec())
+	defer fs.Close()
+	var reply Reply
+	err = NewClient(fs.URL).CallMulti("Arith.Div", []interface{}{&reply}, Args{A: 1, B: 0})
+	_, ok := err.(Fault)
+	assertOk(t, ok, "multiple replies fault")
+}
+
+func Test_DialTimeout(t *testing.T) {
+	// a dialer which never connects until the dial is stopped
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	c := NewClient("http://rpc.test", WithHTTPClient(&http.Client{Transport: transport}), WithDialTimeout(50*time.Millisecond))
+	var n int
+	err := c.Call("Arith.Add", &n)
+	assertOk(t, errors.Is(err, context.DeadlineExceeded), "dial stopped by the dial timeout")
+	_, ok := err.(TimeoutError)
+	assertOk(t, !ok, "dial timeout is not a call timeout")
+
+	ts := newTestServer(NewServerCodec())
+	defer ts.Close()
+	var reply Reply
+	err = NewClient(ts.URL, WithDialTimeout(time.Second)).Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertEqual(t, nil, err, "call with dial timeout no error")
+	assertEqual(t, 3, reply.C, "call with dial timeout")
+}
+
+func Test_InsecureSkipVerify(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewServerCodec(), "text/xml")
+	s.RegisterService(new(Arith), "Arith")
+	newServer := func(maxVersion uint16) *httptest.Server {
+		ts := httptest.NewUnstartedServer(s)
+		ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		ts.TLS = &tls.Config{MaxVersion: maxVersion}
+		ts.StartTLS()
+		return ts
+	}
+	ts := newServer(0)
+	defer ts.Close()
+
+	var reply Reply
+	err := NewClient(ts.URL).Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertNotEqual(t, nil, err, "self-signed certificate rejected by default")
+
+	err = NewClient(ts.URL, WithInsecureSkipVerify()).Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertEqual(t, nil, err, "skip verify no error")
+	assertEqual(t, 3, reply.C, "skip verify reply")
+
+	err = NewClient(ts.URL, WithInsecureSkipVerify(), WithTLSMinVersion(tls.VersionTLS12)).Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertEqual(t, nil, err, "minimum TLS version no error")
+
+	ts12 := newServer(tls.VersionTLS12)
+	defer ts12.Close()
+	err = NewClient(ts12.URL, WithInsecureSkipVerify(), WithTLSMinVersion(tls.VersionTLS13)).Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertNotEqual(t, nil, err, "server below minimum TLS version rejected")
+}
+
+func Test_Proxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("<methodResponse><params><param><value><int>1</int></value></param></params></methodResponse>"))
+	}))
+	defer proxy.Close()
+
+	var n int
+	err := NewClient("http://rpc.example.com/RPC2", WithProxy(proxy.URL)).Call("Arith.Add", &n)
+	assertEqual(t, nil, err, "call through proxy no error")
+	assertEqual(t, 1, n, "call through proxy reply")
+	assertEqual(t, "http://rpc.example.com/RPC2", proxied, "request routed through proxy")
+
+	err = NewClient("http://rpc.example.com/RPC2", WithProxy("http://%zz")).Call("Arith.Add", &n)
+	assertNotEqual(t, nil, err, "invalid proxy URL")
+}
+
+func Test_CookieJar(t *testing.T) {
+	var session string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("session"); err == nil {
+			session = cookie.Value
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc123"})
+		w.Write([]byte("<methodResponse><params><param><value><int>1</int></value></param></params></methodResponse>"))
+	}))
+	defer ts.Close()
+
+	var n int
+	c := NewClient(ts.URL, WithCookieJar(nil))
+	err := c.Call("auth.login", &n)
+	assertEqual(t, nil, err, "login no error")
+	assertEqual(t, "", session, "no cookie before login")
+
+	err = c.Call("Arith.Add", &n)
+	assertEqual(t, nil, err, "call after login no error")
+	assertEqual(t, "abc123", session, "session cookie sent after login")
+
+	session = ""
+	NewClient(ts.URL).Call("Arith.Add", &n)
+	assertEqual(t, "", session, "cookies not stored without a jar")
+}
+
+func Test_HTTPMethod(t *testing.T) {
+	var method string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.Write([]byte("<methodResponse><params><param><value><int>1</int></value></param></params></methodResponse>"))
+	}))
+	defer ts.Close()
+
+	var n int
+	err := NewClient(ts.URL).Call("Arith.Add", &n)
+	assertEqual(t, nil, err, "default method no error")
+	assertEqual(t, http.MethodPost, method, "default method is POST")
+
+	err = NewClient(ts.URL, WithHTTPMethod(http.MethodPut)).Call("Arith.Add", &n)
+	assertEqual(t, nil, err, "configured method no error")
+	assertEqual(t, http.MethodPut, method, "configured method sent")
+}
+
+func Test_ApplicationXMLContentType(t *testing.T) {
+	s := rpc.NewServer()
+	NewServerCodec().Register(s)
+	s.RegisterService(new(Arith), "Arith")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	body := "<methodCall><methodName>Arith.Add</methodName><params><param><value><struct>" +
+		"<member><name>A</name><value><int>2</int></value></member>" +
+		"<member><name>B</name><value><int>3</int></value></member>" +
+		"</struct></value></param></params></methodCall>"
+
+	for _, contentType := range []string{"application/xml", "application/xml; charset=utf-8", "text/xml"} {
+		resp, err := http.Post(ts.URL, contentType, strings.NewReader(body))
+		assertEqual(t, nil, err, "post no error ", contentType)
+		assertEqual(t, http.StatusOK, resp.StatusCode, "post accepted ", contentType)
+		mediaType := strings.Split(contentType, ";")[0]
+		assertEqual(t, mediaType+"; charset=utf-8", resp.Header.Get("Content-Type"), "response content type ", contentType)
+
+		var reply Reply
+		err = NewDecoder(resp.Body).DecodeResponse(&reply)
+		resp.Body.Close()
+		assertEqual(t, nil, err, "decode response no error ", contentType)
+		assertEqual(t, 5, reply.C, "decode response ", contentType)
+	}
+
+	h := NewHandler()
+	h.Register(new(Arith), "Arith")
+	hs := httptest.NewServer(h)
+	defer hs.Close()
+	resp, err := http.Post(hs.URL, "application/xml", strings.NewReader(body))
+	assertEqual(t, nil, err, "handler post no error")
+	resp.Body.Close()
+	assertEqual(t, "application/xml; charset=utf-8", resp.Header.Get("Content-Type"), "handler response content type")
+}
+
+func Test_ClientAuthHeader(t *testing.T) {
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte("<methodResponse><params><param><value><int>1</int></value></param></params></methodResponse>"))
+	}))
+	defer ts.Close()
+
+	var n int
+	err := NewClient(ts.URL, WithBearerToken("abc123")).Call("Arith.Add", &n)
+	assertEqual(t, nil, err, "bearer token no error")
+	assertEqual(t, "Bearer abc123", auth, "bearer token header")
+
+	NewClient(ts.URL, WithBasicAuth("user", "pass"), WithAuthHeader("Token xyz")).Call("Arith.Add", &n)
+	assertEqual(t, "Token xyz", auth, "auth header replaces basic auth")
+
+	NewClient(ts.URL, WithBearerToken("abc123"), WithBasicAuth("user", "pass")).Call("Arith.Add", &n)
+	assertEqual(t, "Basic dXNlcjpwYXNz", auth, "basic auth replaces bearer token")
+}
+
+// newClientCertificate returns a self-signed certificate for client authentication
+func newClientCertificate() (tls.Certificate, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf, nil
+}
+
+func Test_ClientCertificate(t *testing.T) {
+	cert, leaf, err := newClientCertificate()
+	assertEqual(t, nil, err, "create client certificate")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(leaf)
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewServerCodec(), "text/xml")
+	s.RegisterService(new(Arith), "Arith")
+
+	ts := httptest.NewUnstartedServer(s)
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ts.Certificate())
+
+	var reply Reply
+	err = NewClient(ts.URL, WithRootCAs(rootCAs)).Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertNotEqual(t, nil, err, "error without client certificate")
+
+	err = NewClient(ts.URL, WithRootCAs(rootCAs), WithClientCertificate(cert)).Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertEqual(t, nil, err, "client certificate no error")
+	assertEqual(t, 3, reply.C, "client certificate reply")
+}
+
+func Test_Handler(t *testing.T) {
+	h := NewHandler()
+	assertEqual(t, nil, h.Register(new(Arith), ""), "register service")
+	assertNotEqual(t, nil, h.Register(new(Arith), "Arith"), "register duplicate service")
+	assertNotEqual(t, nil, h.Register(new(int), "Int"), "register service without methods")
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	var reply Reply
+	err := c.Call("Arith.Add", &reply, Args{A: 2, B: 3})
+	assertEqual(t, nil, err, "handler Add no error")
+	assertEqual(t, 5, reply.C, "handler Add")
+
+	err = c.Call("Arith.Max", &reply, 5, 9, 7)
+	assertEqual(t, nil, err, "handler Max no error")
+	assertEqual(t, 9, reply.C, "handler Max with positional params")
+
+	err = c.Call("Arith.Div", &reply, Args{A: 1, B: 0})
+	assertOk(t, errors.Is(err, InvalidParams), "handler service fault")
+
+	err = c.Call("Arith.Factorize", &reply, Args{A: 1, B: 0})
+	assertOk(t, errors.Is(err, MethodNotFound), "handler unknown method")
+
+	resp, err := http.Get(ts.URL)
+	assertEqual(t, nil, err, "handler GET no error")
+	assertEqual(t, http.StatusMethodNotAllowed, resp.StatusCode, "handler requires POST")
+	resp.Body.Close()
+}
+
+type Stats struct{}
+
+func (s *Stats) Ratio(r *http.Request, args *Args, reply *float64) error {
+	*reply = float64(args.A) / float64(args.B)
+	return nil
+}
+
+func Test_WriteResponseEncodingError(t *testing.T) {
+	h := NewHandler()
+	h.Register(new(Stats), "")
+	gs := rpc.NewServer()
+	gs.RegisterCodec(NewServerCodec(), "text/xml")
+	gs.RegisterService(new(Stats), "")
+
+	for _, handler := range []http.Handler{h, gs} {
+		ts := httptest.NewServer(handler)
+		c := NewClient(ts.URL)
+
+		var ratio float64
+		err := c.Call("Stats.Ratio", &ratio, Args{A: 1, B: 4})
+		assertEqual(t, nil, err, "finite reply no error")
+		assertEqual(t, 0.25, ratio, "finite reply")
+
+		// 0/0 is NaN which cannot be encoded
+		err = c.Call("Stats.Ratio", &ratio, Args{A: 0, B: 0})
+		assertOk(t, errors.Is(err, InvalidParams), "non-finite reply reported as fault")
+
+		res, err := c.Do(context.Background(), "Stats.Ratio", Args{A: 1, B: 0})
+		assertEqual(t, nil, err, "complete fault response")
+		_, isFault := res.Fault()
+		assertOk(t, isFault, "infinite reply is a fault response")
+		ts.Close()
+	}
+}
+
+func Test_HandlerMiddleware(t *testing.T) {
+	var calls []string
+	h := NewHandler()
+	h.Register(new(Arith), "Arith")
+	h.Use(func(next MethodHandler) MethodHandler {
+		return func(r *http.Request, method string, args interface{}) (interface{}, error) {
+			calls = append(calls, "log "+method)
+			return next(r, method, args)
+		}
+	}, func(next MethodHandler) MethodHandler {
+		return func(r *http.Request, method string, args interface{}) (interface{}, error) {
+			if a, ok := args.(*Args); ok && method == "Arith.Div" && a.B == 0 {
+				return nil, InvalidParams.New("rejected by middleware")
+			}
+			return next(r, method, args)
+		}
+	})
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	var reply Reply
+	err := c.Call("Arith.Add", &reply, Args{A: 2, B: 3})
+	assertEqual(t, nil, err, "middleware passes call no error")
+	assertEqual(t, 5, reply.C, "middleware passes call")
+
+	err = c.Call("Arith.Div", &reply, Args{A: 1, B: 0})
+	fault, ok := err.(Fault)
+	assertOk(t, ok, "middleware rejects call with fault")
+	assertEqual(t, "rejected by middleware", fault.Message, "middleware fault message")
+	assertEqual(t, []string{"log Arith.Add", "log Arith.Div"}, calls, "middleware run in order")
+}
+
+func Test_HandlerPanic(t *testing.T) {
+	var logs bytes.Buffer
+	h := NewHandler(WithLogger(log.New(&logs, "", 0)))
+	h.Register(new(Arith), "Arith")
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	var reply Reply
+	err := c.Call("Arith.Panic", &reply, Args{A: 1, B: 2})
+	fault, ok := err.(Fault)
+	assertOk(t, ok, "panic returns fault")
+	assertEqual(t, int(InternalError), fault.Code, "panic fault code")
+	assertEqual(t, InternalError.String(), fault.Message, "panic fault hides details by default")
+	assertOk(t, strings.HasPrefix(logs.String(), "rpc: panic serving Arith.Panic: boom\n"), "panic logged with the handler logger")
+
+	err = c.Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertEqual(t, nil, err, "serve after panic no error")
+	assertEqual(t, 3, reply.C, "serve after panic")
+
+	debugHandler := NewHandler(WithDebugFaults(true), WithLogger(log.New(ioutil.Discard, "", 0)))
+	debugHandler.Register(new(Arith), "Arith")
+	ds := httptest.NewServer(debugHandler)
+	defer ds.Close()
+
+	err = NewClient(ds.URL).Call("Arith.Panic", &reply, Args{A: 1, B: 2})
+	fault, ok = err.(Fault)
+	assertOk(t, ok, "debug panic returns fault")
+	assertEqual(t, int(InternalError), fault.Code, "debug panic fault code")
+	assertOk(t, strings.HasPrefix(fault.Message, "panic serving Arith.Panic: boom\n"), "debug panic fault message")
+	assertOk(t, strings.Contains(fault.Message, "goroutine"), "debug panic fault has stack")
+}
+
+func Test_RecoverMiddlewarePanic(t *testing.T) {
+	var logs bytes.Buffer
+	h := NewHandler(WithLogger(log.New(&logs, "", 0)))
+	h.Register(new(Arith), "Arith")
+	h.Use(func(next MethodHandler) MethodHandler {
+		return func(r *http.Request, method string, args interface{}) (interface{}, error) {
+			if method == "Arith.Mul" {
+				panic("middleware")
+			}
+			return next(r, method, args)
+		}
+	})
+	hs := httptest.NewServer(h)
+	defer hs.Close()
+
+	var reply Reply
+	err := NewClient(hs.URL).Call("Arith.Mul", &reply, Args{A: 2, B: 3})
+	assertEqual(t, InternalError.New(""), err, "middleware panic returns fault")
+	assertOk(t, strings.HasPrefix(logs.String(), "rpc: panic serving Arith.Mul: middleware\n"), "middleware panic logged")
+
+	// panics in gorilla/rpc services are recovered by the codec handler
+	logs.Reset()
+	codec := NewServerCodec()
+	codec.SetLogger(log.New(&logs, "", 0))
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "text/xml")
+	s.RegisterService(new(Arith), "Arith")
+	ts := httptest.NewServer(codec.Recover(s))
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	err = c.Call("Arith.Panic", &reply, Args{A: 1, B: 2})
+	assertEqual(t, InternalError.New(""), err, "service panic returns fault")
+	assertOk(t, strings.HasPrefix(logs.String(), "rpc: panic serving Arith.Panic: boom\n"), "service panic logged")
+
+	codec.SetDebugFaults(true)
+	err = c.Call("Arith.Panic", &reply, Args{A: 1, B: 2})
+	fault, _ := err.(Fault)
+	assertOk(t, strings.HasPrefix(fault.Message, "panic serving Arith.Panic: boom\n"), "debug service panic fault message")
+
+	err = c.Call("Arith.Add", &reply, Args{A: 1, B: 2})
+	assertEqual(t, nil, err, "serve after service panic no error")
+	assertEqual(t, 3, reply.C, "serve after service panic")
+}
+
+func Test_ErrorMapper(t *testing.T) {
+	mapper := func(err error) (Fault, bool) {
+		if errors.Is(err, os.ErrNotExist) {
+			return Fault{Code: 404, Message: err.Error()}, true
+		}
+		return Fault{}, false
+	}
+
+	var logs bytes.Buffer
+	codec := NewServerCodec()
+	codec.SetLogger(log.New(&logs, "", 0))
+	ts := newTestServer(codec)
+	defer ts.Close()
+
+	// the text of errors which are not faults is logged and hidden from the client
+	var reply Reply
+	err := NewClient(ts.URL).Call("Arith.Open", &reply, "data.txt")
+	assertEqual(t, InternalError.New(""), err, "unmapped error is internal error")
+	assertEqual(t, "rpc: error serving Arith.Open: open data.txt: file does not exist\n", logs.String(), "unmapped error logged")
+
+	codec.SetDebugFaults(true)
+	err = NewClient(ts.URL).Call("Arith.Open", &reply, "data.txt")
+	assertEqual(t, InternalError.New("open data.txt: file does not exist"), err, "debug unmapped error")
+	codec.SetDebugFaults(false)
+
+	codec.SetErrorMapper(mapper)
+	err = NewClient(ts.URL).Call("Arith.Open", &reply, "data.txt")
+	assertEqual(t, Fault{Code: 404, Message: "open data.txt: file does not exist"}, err, "mapped error fault")
+
+	err = NewClient(ts.URL).Call("Arith.Div", &reply, Args{A: 1, B: 0})
+	assertOk(t, errors.Is(err, InvalidParams), "faults are not mapped")
+
+	logs.Reset()
+	h := NewHandler(WithLogger(log.New(&logs, "", 0)))
+	h.Register(new(Arith), "Arith")
+	hs := httptest.NewServer(h)
+	defer hs.Close()
+
+	err = NewClient(hs.URL).Call("Arith.Open", &reply, "data.txt")
+	assertEqual(t, InternalError.New(""), err, "handler hides unmapped error")
+	assertEqual(t, "rpc: error serving Arith.Open: open data.txt: file does not exist\n", logs.String(), "handler unmapped error logged")
+
+	h.SetErrorMapper(mapper)
+	err = NewClient(hs.URL).Call("Arith.Open", &reply, "data.txt")
+	assertEqual(t, Fault{Code: 404, Message: "open data.txt: file does not exist"}, err, "handler mapped error fault")
+}
+
+func Test_ClientMapReply(t *testing.T) {
+	ts := newTestServer(NewServerCodec())
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	var reply map[string]int
+	err := c.Call("Arith.Add", &reply, Args{A: 2, B: 3})
+	assertEqual(t, nil, err, "map reply no error")
+	assertEqual(t, map[string]int{"C": 5}, reply, "map reply")
+
+	var generic map[string]interface{}
+	err = c.Call("Arith.Mul", &generic, Args{A: 2, B: 3})
+	assertEqual(t, nil, err, "generic map reply no error")
+	assertEqual(t, map[string]interface{}{"C": 6}, generic, "generic map reply")
+
+	var invalid map[int]int
+	err = c.Call("Arith.Add", &invalid, Args{A: 2, B: 3})
+	assertNotEqual(t, nil, err, "map reply requires string keys")
+}
+
+func Test_ClientResponse(t *testing.T) {
+	ts := newTestServer(NewServerCodec())
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	var res MethodResponse
+	err := c.Call("Arith.Div", &res, Args{A: 1, B: 0})
+	assertEqual(t, nil, err, "fault response no error")
+	fault, ok := res.Fault()
+	assertOk(t, ok, "fault response has fault")
+	assertEqual(t, int(InvalidParams), fault.Code, "fault response code")
+	assertEqual(t, 0, len(res.Params()), "fault response has no result")
+
+	var reply Reply
+	assertEqual(t, fault, res.Decode(&reply), "decode fault response returns fault")
+
+	err = c.Call("Arith.Add", &res, Args{A: 2, B: 3})
+	assertEqual(t, nil, err, "result response no error")
+	_, ok = res.Fault()
+	assertOk(t, !ok, "result response has no fault")
+	assertEqual(t, nil, res.Decode(&reply), "decode result response no error")
+	assertEqual(t, 5, reply.C, "decode result response")
+	assertEqual(t, "struct{C: 5}", res.Params()[0].String(), "result response value")
+}
+
+// idleRecorder records calls to CloseIdleConnections
+type idleRecorder struct {
+	http.RoundTripper
+	closed int
+}
+
+func (r *idleRecorder) CloseIdleConnections() {
+	r.closed++
+}
+
+func Test_ClientClose(t *testing.T) {
+	var mu sync.Mutex
+	closed := 0
+	s := rpc.NewServer()
+	s.RegisterCodec(NewServerCodec(), "text/xml")
+	s.RegisterService(new(Arith), "Arith")
+	ts := httptest.NewUnstartedServer(s)
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			mu.Lock()
+			closed++
+			mu.Unlock()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	// the dial timeout gives the client a transport of its own
+	c := NewClient(ts.URL, WithDialTimeout(time.Second))
+	var reply Reply
+	err := c.Call("Arith.Add", &reply, Args{A: 2, B: 3})
+	assertEqual(t, nil, err, "call no error")
+	c.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := closed
+		mu.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			assertEqual(t, 1, n, "idle connection closed")
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err = c.Call("Arith.Add", &reply, Args{A: 2, B: 3})
+	assertEqual(t, nil, err, "call after close no error")
+	assertEqual(t, 5, reply.C, "call after close")
+
+	// a transport supplied by the caller is left open
+	rt := &idleRecorder{RoundTripper: http.DefaultTransport}
+	c = NewClient(ts.URL, WithRoundTripper(rt))
+	c.Close()
+	assertEqual(t, 0, rt.closed, "caller transport left open")
+
+	c = NewClient(ts.URL, WithHTTPClient(&http.Client{Transport: rt}))
+	c.Close()
+	assertEqual(t, 0, rt.closed, "caller client left open")
+}
+
+func Test_ClientManyMethods(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<methodResponse><params><param><value><int>1</int></value></param></params></methodResponse>"))
+	})
+	c := NewClient("http://rpc", WithRoundTripper(NewInMemoryTransport(handler)))
+
+	// the client keeps no state per method. pointers are printed as addresses so nested state is not compared
+	before := fmt.Sprintf("%+v", *c)
+	var n int
+	for i := 0; i < 1000; i++ {
+		err := c.Call(fmt.Sprintf("Service.Method%d", i), &n)
+		assertEqual(t, nil, err, "call no error")
+	}
+	assertEqual(t, before, fmt.Sprintf("%+v", *c), "client unchanged by many distinct methods")
+	assertOk(t, c.codecs == codecPool, "client uses the shared codec pool")
+}
+
+func Test_ClientMaxResponseSize(t *testing.T) {
+	response := "<methodResponse><params><param><value><string>" + strings.Repeat("x", 1000) + "</string></value></param></params></methodResponse>"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	}))
+	defer ts.Close()
+
+	var s string
+	err := NewClient(ts.URL, WithMaxResponseSize(512)).Call("Big.Value", &s)
+	assertOk(t, errors.Is(err, MalformedInput), "response exceeding limit fails with malformed input. ", err)
+	assertEqual(t, "", s, "response exceeding limit not decoded")
+
+	err = NewClient(ts.URL, WithMaxResponseSize(512), WithResponseLogger(func([]byte) {})).Call("Big.Value", &s)
+	assertOk(t, errors.Is(err, MalformedInput), "logged response exceeding limit fails with malformed input. ", err)
+
+	err = NewClient(ts.URL, WithMaxResponseSize(int64(len(response)))).Call("Big.Value", &s)
+	assertEqual(t, nil, err, "response at limit no error")
+	assertEqual(t, 1000, len(s), "response at limit")
+}
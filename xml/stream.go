@@ -0,0 +1,112 @@
+package xml
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// An Encoder writes XML-RPC values and messages to an output stream.
+type Encoder struct {
+	w     io.Writer
+	codec *Codec
+}
+
+// NewEncoder returns a new encoder that writes to w using a codec configured with the given options.
+func NewEncoder(w io.Writer, options ...func(*Codec)) *Encoder {
+	return &Encoder{w: w, codec: NewCodec(options...)}
+}
+
+// Encode writes the XML-RPC encoding of v as a <value> element.
+func (e *Encoder) Encode(v interface{}) error {
+	return e.codec.writeRPC(e.w, v)
+}
+
+// EncodeRequest writes an XML-RPC methodCall for the method with the given arguments.
+func (e *Encoder) EncodeRequest(method string, args ...interface{}) error {
+	return e.codec.writeRequest(e.w, method, args...)
+}
+
+// EncodeResponse writes an XML-RPC methodResponse with the result as the param.
+// The response is a fault if the result is a Fault or an error.
+func (e *Encoder) EncodeResponse(result interface{}) error {
+	return e.codec.writeResponse(e.w, result)
+}
+
+// A Decoder reads XML-RPC values and messages from an input stream.
+type Decoder struct {
+	codec *Codec
+}
+
+// NewDecoder returns a new decoder that reads from r using a codec configured with the given options.
+func NewDecoder(r io.Reader, options ...func(*Codec)) *Decoder {
+	d := &Decoder{codec: NewCodec(options...)}
+	d.codec.rd.reset(r)
+	return d
+}
+
+// Decode reads the next <value> element and stores it in the value pointed to by v.
+// It returns io.EOF when there is no more input.
+func (d *Decoder) Decode(v interface{}) error {
+	if err := d.more(); err != nil {
+		return err
+	}
+	return d.codec.decode(v)
+}
+
+// PresentFields returns the names of the struct members in the value read by the last call to Decode
+// when the codec of the decoder tracks them with TrackPresentFields. Nested member names are joined with a dot.
+func (d *Decoder) PresentFields() map[string]bool {
+	return d.codec.present
+}
+
+// DecodeRequest reads the next methodCall and stores the method name in method
+// and the params in the value pointed to by params.
+// Multiple params are stored in the slice pointed to by params.
+func (d *Decoder) DecodeRequest(method *string, params interface{}) error {
+	if err := d.more(); err != nil {
+		return err
+	}
+	return d.codec.decodeRequest(method, params)
+}
+
+// DecodeResponse reads the next methodResponse and stores its result in the value pointed to by reply.
+// If the response is a fault, the error will be of type Fault,
+// unless reply is a *MethodResponse which keeps the fault instead.
+func (d *Decoder) DecodeResponse(reply interface{}) error {
+	if err := d.more(); err != nil {
+		return err
+	}
+	return d.codec.decodeResponse(reply)
+}
+
+// more returns io.EOF when there is no more input to decode
+func (d *Decoder) more() error {
+	rd := d.codec.rd
+	rd.trim()
+	t, err := rd.token()
+	if t == nil {
+		return err
+	}
+	rd.putToken(t)
+	return nil
+}
+
+// DecodeArrayStream reads the next <value> element which must be an array and calls fn for each element in order.
+// Elements are not retained so arrays of any size are decoded in constant memory.
+// The element is only valid until fn returns. Decoding stops at the first error returned by fn.
+func (d *Decoder) DecodeArrayStream(fn func(index int, elem *Value) error) error {
+	if err := d.more(); err != nil {
+		return err
+	}
+	c := d.codec
+	c.rd.count = 0
+	elem := Value{cfg: &c.cfg}
+	err := c.rd.readArrayStream(func(i int, v *rpcValue) error {
+		elem.rpc = *v
+		return fn(i, &elem)
+	})
+	if v, ok := err.(*xml.SyntaxError); ok {
+		return MalformedInput.New(v.Error())
+	}
+	return err
+}
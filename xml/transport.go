@@ -0,0 +1,90 @@
+package xml
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// inMemoryTransport sends requests directly to a handler without a network connection
+type inMemoryTransport struct {
+	handler http.Handler
+}
+
+// NewInMemoryTransport returns a transport which serves each request with the handler in the same process.
+// It is intended for testing clients against a server, such as a gorilla/rpc server using the ServerCodec,
+// without a network connection.
+func NewInMemoryTransport(handler http.Handler) http.RoundTripper {
+	return &inMemoryTransport{handler: handler}
+}
+
+// RoundTrip serves the request with the handler and returns the recorded response.
+// The request body is closed once served. A canceled request returns the context error
+// without waiting for the handler
+func (t *inMemoryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := r.Context()
+	if err := ctx.Err(); err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, err
+	}
+
+	// the handler reads the request as a server would
+	req := r.Clone(ctx)
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+
+	rw := &responseRecorder{header: make(http.Header)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer req.Body.Close()
+		t.handler.ServeHTTP(rw, req)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+	}
+
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rw.status, http.StatusText(rw.status)),
+		StatusCode:    rw.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rw.header,
+		Body:          ioutil.NopCloser(&rw.body),
+		ContentLength: int64(rw.body.Len()),
+		Request:       r,
+	}, nil
+}
+
+// responseRecorder records the status, headers and body written by a handler
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
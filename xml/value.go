@@ -0,0 +1,177 @@
+package xml
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Value is a decoded XML-RPC value.
+// Values may be passed as params to re-encode them unchanged.
+type Value struct {
+	rpc rpcValue
+	cfg *codecConfig
+}
+
+// Decode stores the value in the value pointed to by v.
+func (v *Value) Decode(target interface{}) error {
+	if err := checkPointer(target); err != nil {
+		return err
+	}
+	cfg := v.cfg
+	if cfg == nil {
+		cfg = &codecConfig{}
+	}
+	return v.rpc.writeTo(target, cfg)
+}
+
+// A MethodCall is an XML-RPC request which can be written with an Encoder and read with a Decoder.
+type MethodCall struct {
+	call methodCall
+	cfg  *codecConfig
+	// build converts the params given to NewMethodCall with the settings of the codec writing the call
+	build func(cfg *codecConfig) (methodCall, error)
+}
+
+// NewMethodCall returns a request for the method with the given params.
+// The params are converted again with the settings of the Encoder writing the call.
+func NewMethodCall(method string, params ...interface{}) (*MethodCall, error) {
+	cfg := &codecConfig{}
+	call, err := makeCall(cfg, method, params...)
+	if err != nil {
+		return nil, err
+	}
+	build := func(cfg *codecConfig) (methodCall, error) {
+		return makeCall(cfg, method, params...)
+	}
+	return &MethodCall{call: call, cfg: cfg, build: build}, nil
+}
+
+// Method returns the name of the method called.
+func (m *MethodCall) Method() string {
+	return m.call.Method
+}
+
+// Params returns the params of the call.
+func (m *MethodCall) Params() []*Value {
+	return values(m.call.Params, m.cfg)
+}
+
+// A MethodResponse is an XML-RPC response which can be written with an Encoder and read with a Decoder.
+type MethodResponse struct {
+	res methodResponse
+	cfg *codecConfig
+	// build converts the result given to NewMethodResponse with the settings of the codec writing the response
+	build func(cfg *codecConfig) (methodResponse, error)
+}
+
+// NewMethodResponse returns a response with the result as the param.
+// The response is a fault if the result is a Fault or an error.
+// The result is converted again with the settings of the Encoder writing the response.
+func NewMethodResponse(result interface{}) (*MethodResponse, error) {
+	cfg := &codecConfig{}
+	res, err := makeResponse(cfg, result)
+	if err != nil {
+		return nil, err
+	}
+	build := func(cfg *codecConfig) (methodResponse, error) {
+		return makeResponse(cfg, result)
+	}
+	return &MethodResponse{res: res, cfg: cfg, build: build}, nil
+}
+
+// Params returns the params of the response. Faults have no params.
+func (m *MethodResponse) Params() []*Value {
+	return values(m.res.Params, m.cfg)
+}
+
+// Fault returns the fault of the response and whether the response is a fault.
+func (m *MethodResponse) Fault() (Fault, bool) {
+	fault, ok := m.res.fault(m.config()).(Fault)
+	return fault, ok
+}
+
+// Decode stores the first param of the response in the value pointed to by reply.
+// It returns the fault when the response is a fault.
+func (m *MethodResponse) Decode(reply interface{}) error {
+	if err := m.res.fault(m.config()); err != nil {
+		return err
+	}
+	return m.res.rpcParams.writeTo(reply, m.config())
+}
+
+// config returns the settings of the codec which read or created the response
+func (m *MethodResponse) config() *codecConfig {
+	if m.cfg == nil {
+		return &codecConfig{}
+	}
+	return m.cfg
+}
+
+// values wraps the params as values
+func values(params []rpcValue, cfg *codecConfig) []*Value {
+	vals := make([]*Value, 0, len(params))
+	for _, p := range params {
+		vals = append(vals, &Value{rpc: p, cfg: cfg})
+	}
+	return vals
+}
+
+// Interface returns the value as native Go types.
+// Arrays are returned as []interface{} and structs as map[string]interface{}.
+// Other values are returned as bool, int, int64, float64, string, []byte, time.Time or nil.
+func (v *Value) Interface() interface{} {
+	return v.rpc.native()
+}
+
+// String returns a readable representation of the value tree for debugging,
+// such as struct{name: "Kofi", tags: array["a", "b"]}.
+func (v *Value) String() string {
+	var b strings.Builder
+	v.rpc.dump(&b)
+	return b.String()
+}
+
+// dump writes a readable representation of the value
+func (r rpcValue) dump(b *strings.Builder) {
+	switch r.kind {
+	case nilKind:
+		b.WriteString("nil")
+	case stringKind:
+		b.WriteString(strconv.Quote(r.value.(string)))
+	case doubleKind:
+		b.WriteString(formatDouble(r.value))
+	case base64Kind:
+		b.WriteString("base64(")
+		b.WriteString(base64.StdEncoding.EncodeToString(r.value.([]byte)))
+		b.WriteString(")")
+	case dateTimeKind:
+		b.WriteString("dateTime(")
+		b.WriteString(r.value.(time.Time).Format(iso8601Nano))
+		b.WriteString(")")
+	case arrayKind:
+		b.WriteString("array[")
+		for i, item := range r.value.([]rpcValue) {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			item.dump(b)
+		}
+		b.WriteString("]")
+	case structKind:
+		b.WriteString("struct{")
+		for i, member := range r.value.([]rpcEntry) {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(member.Name)
+			b.WriteString(": ")
+			member.Value.dump(b)
+		}
+		b.WriteString("}")
+	default:
+		fmt.Fprint(b, r.value)
+	}
+}
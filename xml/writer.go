@@ -1,10 +1,13 @@
 package xml
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/xml"
-	"fmt"
 	"io"
+	"math"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -30,6 +33,9 @@ const (
 	paramListTag      xmlTag = iota
 	paramTag          xmlTag = iota
 	faultTag          xmlTag = iota
+	nilTag            xmlTag = iota
+	i8Tag             xmlTag = iota
+	i4Tag             xmlTag = iota
 )
 
 var (
@@ -52,9 +58,12 @@ var (
 		paramListTag:      "params",
 		paramTag:          "param",
 		faultTag:          "fault",
+		nilTag:            "nil",
+		i8Tag:             "i8",
+		i4Tag:             "i4",
 	}
-	startTags     [18]string
-	endTags       [18]string
+	startTags     [21]string
+	endTags       [21]string
 	boolEncodeMap = map[bool]string{true: "1", false: "0"}
 )
 
@@ -72,16 +81,24 @@ func init() {
 
 // writes XML-RPC values to an io.Writer
 type xmlWriter struct {
-	wr io.Writer
+	wr  io.Writer
+	cfg *codecConfig
+
+	// indentation state
+	depth    int  // current nesting of elements
+	nested   bool // whether the current element contains elements
+	indented bool // whether any indentation has been written
 }
 
 func newWriter(w io.Writer) *xmlWriter {
-	return &xmlWriter{wr: w}
+	return &xmlWriter{wr: w, cfg: &codecConfig{}}
 }
 
 func (w *xmlWriter) reset(wr io.Writer) {
-	w.Flush()
 	w.wr = wr
+	w.depth = 0
+	w.nested = false
+	w.indented = false
 }
 
 func (w *xmlWriter) Flush() error {
@@ -93,30 +110,85 @@ func (w *xmlWriter) Flush() error {
 
 // writeRaw write the given raw value enclosed in the specified tag
 func (w *xmlWriter) writeRaw(t xmlTag, raw string) error {
-	if _, err := io.WriteString(w.wr, startTags[t]); err != nil {
+	if err := w.writeStart(t); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w.wr, raw); err != nil {
 		return err
 	}
-	_, err := io.WriteString(w.wr, endTags[t])
-	return err
+	return w.writeEnd(t)
 }
 
 // writeXML invokes the given function wrapped in the specified tag
 func (w *xmlWriter) writeXML(t xmlTag, fn func() error) error {
-	if _, err := io.WriteString(w.wr, startTags[t]); err != nil {
+	if err := w.writeStart(t); err != nil {
 		return err
 	}
 	if err := fn(); err != nil {
 		return err
 	}
+	return w.writeEnd(t)
+}
+
+// writeStart writes the start tag, indented on a new line if configured
+func (w *xmlWriter) writeStart(t xmlTag) error {
+	if w.cfg.indent != "" || w.cfg.prefix != "" {
+		if err := w.writeIndent(); err != nil {
+			return err
+		}
+		w.depth++
+		w.nested = false
+	}
+	_, err := io.WriteString(w.wr, startTags[t])
+	return err
+}
+
+// writeEnd writes the end tag, indented on a new line if the element contains elements
+func (w *xmlWriter) writeEnd(t xmlTag) error {
+	if w.cfg.indent != "" || w.cfg.prefix != "" {
+		w.depth--
+		if w.nested {
+			if err := w.writeIndent(); err != nil {
+				return err
+			}
+		}
+		// the parent now contains this element
+		w.nested = true
+	}
 	_, err := io.WriteString(w.wr, endTags[t])
 	return err
 }
 
+// writeIndent starts a new line with the prefix and indentation of the current depth
+func (w *xmlWriter) writeIndent() error {
+	if w.indented {
+		if _, err := io.WriteString(w.wr, "\n"); err != nil {
+			return err
+		}
+	}
+	w.indented = true
+	if _, err := io.WriteString(w.wr, w.cfg.prefix); err != nil {
+		return err
+	}
+	for i := 0; i < w.depth; i++ {
+		if _, err := io.WriteString(w.wr, w.cfg.indent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHeader writes the XML declaration unless omitted
+func (w *xmlWriter) writeHeader() error {
+	if w.cfg.omitHeader {
+		return nil
+	}
+	_, err := io.WriteString(w.wr, xml.Header)
+	return err
+}
+
 func (w *xmlWriter) writeCall(rpc methodCall) error {
-	if _, err := io.WriteString(w.wr, xml.Header); err != nil {
+	if err := w.writeHeader(); err != nil {
 		return err
 	}
 	return w.writeXML(methodCallTag, func() error {
@@ -138,7 +210,7 @@ func (w *xmlWriter) writeCall(rpc methodCall) error {
 }
 
 func (w *xmlWriter) writeResponse(rpc methodResponse) error {
-	if _, err := io.WriteString(w.wr, xml.Header); err != nil {
+	if err := w.writeHeader(); err != nil {
 		return err
 	}
 	return w.writeXML(methodResponseTag, func() error {
@@ -161,20 +233,66 @@ func (w *xmlWriter) writeResponse(rpc methodResponse) error {
 	})
 }
 
+// formatDouble formats a float with the fewest digits for an exact round-trip.
+// XML-RPC does not allow exponents so the decimal notation always includes a decimal point
+func formatDouble(value interface{}) string {
+	v := reflect.ValueOf(value)
+	var a [32]byte
+	b := strconv.AppendFloat(a[:0], v.Float(), 'f', -1, v.Type().Bits())
+	if bytes.IndexByte(b, '.') == -1 {
+		b = append(b, ".0"...)
+	}
+	return string(b)
+}
+
+// writeDouble writes a float rejecting NaN and infinity which XML-RPC cannot represent
+func (w *xmlWriter) writeDouble(value interface{}) error {
+	f := reflect.ValueOf(value).Float()
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return InvalidParams.New("double %v is not supported", f)
+	}
+	return w.writeRaw(doubleTag, formatDouble(value))
+}
+
+// writeInt writes an integer as <int> when it fits in 32 bits and as <i8> otherwise
+func (w *xmlWriter) writeInt(value interface{}) error {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := v.Uint()
+		if n > math.MaxInt64 {
+			return InvalidParams.New("integer %d overflows i8", n)
+		}
+		if n > math.MaxInt32 {
+			return w.writeRaw(i8Tag, strconv.FormatUint(n, 10))
+		}
+		return w.writeRaw(w.intTag(), strconv.FormatUint(n, 10))
+	default:
+		n := v.Int()
+		if n < math.MinInt32 || n > math.MaxInt32 {
+			return w.writeRaw(i8Tag, strconv.FormatInt(n, 10))
+		}
+		return w.writeRaw(w.intTag(), strconv.FormatInt(n, 10))
+	}
+}
+
+// intTag returns the tag for 32-bit integers
+func (w *xmlWriter) intTag() xmlTag {
+	if w.cfg.useI4 {
+		return i4Tag
+	}
+	return intTag
+}
+
 func (w *xmlWriter) writeValue(rpc rpcValue) error {
 	return w.writeXML(valueTag, func() error {
 		switch rpc.kind {
 		case intKind:
-			return w.writeRaw(intTag, fmt.Sprint(rpc.value))
+			return w.writeInt(rpc.value)
 		case booleanKind:
 			return w.writeRaw(booleanTag, boolEncodeMap[rpc.value.(bool)])
 		case doubleKind:
-			d := fmt.Sprintf("%f", rpc.value)
-			d = strings.TrimRight(d, "0")
-			if len(d) == 0 || d[len(d)-1] == '.' {
-				d = d + "0"
-			}
-			return w.writeRaw(doubleTag, d)
+			return w.writeDouble(rpc.value)
 		case stringKind:
 			s := rpc.value.(string)
 			if strings.IndexAny(s, `<>&'"`) == -1 {
@@ -185,9 +303,13 @@ func (w *xmlWriter) writeValue(rpc rpcValue) error {
 			})
 		case dateTimeKind:
 			t := rpc.value.(time.Time)
+			if w.cfg.timeLocation != nil {
+				t = t.In(w.cfg.timeLocation)
+			}
 			var a [64]byte
 			b := a[:0]
-			return w.writeRaw(dateTimeTag, string(t.AppendFormat(b, iso8601)))
+			// fractional seconds are only written when present
+			return w.writeRaw(dateTimeTag, string(t.AppendFormat(b, iso8601Nano)))
 		case base64Kind:
 			return w.writeRaw(base64Tag, base64.StdEncoding.EncodeToString(rpc.value.([]byte)))
 		case arrayKind:
@@ -219,6 +341,10 @@ func (w *xmlWriter) writeValue(rpc rpcValue) error {
 				return nil
 			})
 		default:
+			if w.cfg.nilExtension {
+				_, err := io.WriteString(w.wr, "<nil/>")
+				return err
+			}
 			return nil
 		}
 	})